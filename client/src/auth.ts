@@ -0,0 +1,45 @@
+// Access token for cameras that require authentication (auth_token or a JWT).
+// Open the page once as `/?token=...`; the token is kept in localStorage and
+// removed from the address bar. Cameras using HTTP Basic auth need nothing
+// here, the browser prompts for and resends the credentials itself.
+//
+// Share links (`share:` tokens) are kept in sessionStorage instead, so they
+// only apply to the tab the link was opened in and never replace the
+// account token of the browser's owner.
+
+const TOKEN_KEY = "accessToken";
+const SHARE_TOKEN_KEY = "shareToken";
+const SHARE_TOKEN_PREFIX = "share:";
+
+const readToken = (): string | null => {
+  const url = new URL(window.location.href);
+  const fromUrl = url.searchParams.get("token");
+  if (fromUrl) {
+    if (fromUrl.startsWith(SHARE_TOKEN_PREFIX)) {
+      window.sessionStorage.setItem(SHARE_TOKEN_KEY, fromUrl);
+    } else {
+      window.localStorage.setItem(TOKEN_KEY, fromUrl);
+    }
+    url.searchParams.delete("token");
+    window.history.replaceState(null, "", url);
+    return fromUrl;
+  }
+  return (
+    window.sessionStorage.getItem(SHARE_TOKEN_KEY) ??
+    window.localStorage.getItem(TOKEN_KEY)
+  );
+};
+
+const token = readToken();
+
+// Headers for a fetch to a camera endpoint
+export const authHeaders = (
+  headers: Record<string, string> = {},
+): Record<string, string> =>
+  token ? { ...headers, Authorization: `Bearer ${token}` } : headers;
+
+// URL with the token as a query parameter, for links and WebSockets that cannot send headers
+export const withAccessToken = (url: string): string =>
+  token
+    ? `${url}${url.includes("?") ? "&" : "?"}access_token=${encodeURIComponent(token)}`
+    : url;
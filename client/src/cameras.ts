@@ -1,10 +1,15 @@
+import { authHeaders } from "./auth";
+
 export interface CameraInfo {
   endpoint: string;
   title: string;
 }
 
 export async function getCameras(): Promise<CameraInfo[]> {
-  const response = await fetch("/cameras", { method: "GET" });
+  const response = await fetch("/cameras", {
+    method: "GET",
+    headers: authHeaders(),
+  });
   if (!response.ok) {
     throw new Error(`Failed to fetch cameras: ${response.statusText}`);
   }
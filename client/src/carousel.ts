@@ -1,5 +1,6 @@
 import type { CameraInfo } from "./cameras";
 import { startStream } from "./connect";
+import type { StreamConnection } from "./connect";
 import { getStorage, setStorage } from "./storage";
 
 interface VideoElements {
@@ -15,7 +16,7 @@ export class Carousel {
   private cameras: CameraInfo[];
   private isTransitioning: boolean = false;
   private videoElements: Map<number, VideoElements> = new Map();
-  private connections: Map<number, RTCPeerConnection> = new Map();
+  private connections: Map<number, StreamConnection> = new Map();
   private onIndexChangeCallbacks: Array<(index: number) => void> = [];
 
   constructor(cameras: CameraInfo[], _container: HTMLElement) {
@@ -195,7 +196,7 @@ export class Carousel {
   /**
    * Ensure a connection exists for the given camera index
    */
-  async ensureConnection(index: number): Promise<RTCPeerConnection | null> {
+  async ensureConnection(index: number): Promise<StreamConnection | null> {
     // Check if connection already exists
     if (this.connections.has(index)) {
       return this.connections.get(index)!;
@@ -211,7 +212,7 @@ export class Carousel {
     try {
       // Start WebRTC stream
       const camera = this.cameras[index];
-      const pc = await startStream({
+      const connection = await startStream({
         url: camera.endpoint,
         name: camera.title,
         videoElement: elements.videoElement,
@@ -220,12 +221,12 @@ export class Carousel {
         timeElement: elements.timeElement,
       });
 
-      if (pc) {
-        this.connections.set(index, pc);
+      if (connection) {
+        this.connections.set(index, connection);
         console.log(`Connected to camera ${index + 1}`);
       }
 
-      return pc;
+      return connection;
     } catch (error) {
       console.error(`Failed to connect to camera ${index + 1}:`, error);
       return null;
@@ -255,10 +256,10 @@ export class Carousel {
    * Cleanup connections that are far from the current camera
    */
   private cleanupDistant(currentIndex: number, threshold = 2): void {
-    for (const [index, pc] of this.connections.entries()) {
+    for (const [index, connection] of this.connections.entries()) {
       if (Math.abs(index - currentIndex) > threshold) {
         console.log(`Cleaning up connection to camera ${index + 1}`);
-        pc.close();
+        connection.close();
         this.connections.delete(index);
       }
     }
@@ -267,13 +268,13 @@ export class Carousel {
   /**
    * Force reconnect to a specific camera
    */
-  async reconnect(index: number): Promise<RTCPeerConnection | null> {
+  async reconnect(index: number): Promise<StreamConnection | null> {
     console.log(`Force reconnecting to camera ${index + 1}`);
 
     // Close existing connection if it exists
-    const existingPc = this.connections.get(index);
-    if (existingPc) {
-      existingPc.close();
+    const existing = this.connections.get(index);
+    if (existing) {
+      existing.close();
       this.connections.delete(index);
     }
 
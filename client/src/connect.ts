@@ -1,3 +1,4 @@
+import { withAccessToken } from "./auth";
 import { startObjectDetection } from "./detector";
 import { getStorage } from "./storage";
 
@@ -26,16 +27,65 @@ const updateConnectionStatus = (
   }
 };
 
+/**
+ * Message on the camera's /ws signaling socket (see "WebSocket Signaling" in docs/DEVELOPMENT.md)
+ */
+interface SignalMessage {
+  type: "iceServers" | "offer" | "answer" | "candidate" | "close" | "error";
+  sdp?: string;
+  candidate?: RTCIceCandidateInit;
+  reason?: string;
+  iceServers?: RTCIceServer[];
+}
+
+// Attempts to reopen a dropped signaling socket before giving up; the
+// Reconnect button then starts a new session
+const MAX_SIGNALING_RETRIES = 5;
+
+/**
+ * Open the signaling socket of a camera. Resolves once the server has sent
+ * its STUN/TURN servers (with short-lived TURN credentials), which come first.
+ */
+const openSignaling = (
+  url: string,
+): Promise<{ ws: WebSocket; iceServers: RTCIceServer[] }> =>
+  new Promise((resolve, reject) => {
+    // The token goes in the URL, as WebSockets cannot send an Authorization header
+    const wsUrl = new URL(withAccessToken(`${url}/ws`), window.location.href);
+    wsUrl.protocol = wsUrl.protocol === "https:" ? "wss:" : "ws:";
+    const ws = new WebSocket(wsUrl);
+    ws.onmessage = (event) => {
+      const msg = JSON.parse(event.data) as SignalMessage;
+      if (msg.type === "iceServers") {
+        ws.onmessage = null;
+        ws.onclose = null;
+        resolve({ ws, iceServers: msg.iceServers ?? [] });
+      }
+    };
+    ws.onclose = (event) =>
+      reject(new Error(`Signaling closed (${event.reason || event.code})`));
+  });
+
+/**
+ * A camera stream: its peer connection and the signaling socket behind it
+ */
+export interface StreamConnection {
+  pc: RTCPeerConnection;
+  close(): void; // Hang up: closes the signaling socket and the peer connection
+}
+
 /**
  * Start a WebRTC stream from the given video feed configuration.
- * Sets up a RTCPeerConnection, handles ICE candidates, and manages the video element.
+ * Sets up a RTCPeerConnection, signals it over the camera's /ws socket, and manages the video element.
  *
  * Production-grade notes in-code:
+ * - Offer, answer and ICE candidates are trickled over the socket, so nothing waits for ICE gathering.
+ * - A dropped socket is reopened and the connection recovered with an ICE restart, not a new session.
  * - Use structured messages on the stats data channel (JSON).
  * - Rely on connectionState events for authoritative connection time.
  * - Update visible badges directly (no DOM observation required).
  *
- * @returns RTCPeerConnection instance for lifecycle management (or null on error)
+ * @returns StreamConnection for lifecycle management (or null on error)
  */
 export async function startStream(videoFeedConfig: {
   url: string;
@@ -45,13 +95,13 @@ export async function startStream(videoFeedConfig: {
   // visible badge elements
   droppedElement?: HTMLElement;
   timeElement?: HTMLElement;
-}): Promise<RTCPeerConnection | null> {
+}): Promise<StreamConnection | null> {
   const { url, videoElement, connectionElement, droppedElement, timeElement } =
     videoFeedConfig;
   try {
-    const pc = new RTCPeerConnection({
-      iceServers: [],
-    });
+    const signaling = await openSignaling(url);
+    let ws = signaling.ws;
+    const pc = new RTCPeerConnection({ iceServers: signaling.iceServers });
 
     pc.addTransceiver("video", { direction: "recvonly" });
 
@@ -150,8 +200,16 @@ export async function startStream(videoFeedConfig: {
       console.log(`Data channel closed`);
     };
 
+    const send = (msg: SignalMessage) => {
+      if (ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify(msg));
+      }
+    };
+
+    // Trickle local candidates; a null candidate ends them
     pc.onicecandidate = (event) => {
       console.log("ICE candidate:", event.candidate);
+      send({ type: "candidate", candidate: event.candidate?.toJSON() });
     };
 
     pc.ontrack = (event) => {
@@ -216,50 +274,140 @@ export async function startStream(videoFeedConfig: {
       console.log("ICE connection state:", pc.iceConnectionState);
     };
 
-    const offer = await pc.createOffer();
-    await pc.setLocalDescription(offer);
+    // Session state: the first answer establishes it; after that a dropped
+    // socket is recovered rather than reported
+    let hungUp = false;
+    let established = false;
+    let closeReason = "";
+    let retries = 0; // Signaling reconnects since the last answer
+    let resolveAnswered: () => void = () => {};
+    let rejectAnswered: (err: Error) => void = () => {};
+    const answered = new Promise<void>((resolve, reject) => {
+      resolveAnswered = resolve;
+      rejectAnswered = reject;
+    });
 
-    await Promise.race<void>([
-      new Promise((resolve) => {
-        if (pc.iceGatheringState === "complete") {
-          resolve();
-        } else {
-          pc.addEventListener(
-            "icegatheringstatechange",
-            function onStateChange() {
-              if (pc.iceGatheringState === "complete") {
-                pc.removeEventListener(
-                  "icegatheringstatechange",
-                  onStateChange,
-                );
-                resolve();
-              }
-            },
-          );
-        }
-      }),
-      new Promise((resolve) => setTimeout(resolve, 2000)),
-    ]);
+    const handleMessage = async (msg: SignalMessage) => {
+      switch (msg.type) {
+        case "answer":
+          try {
+            await pc.setRemoteDescription({ type: "answer", sdp: msg.sdp });
+          } catch (err) {
+            // e.g. the server restarted with a new DTLS certificate; the
+            // ICE restart cannot recover that, a new session is needed
+            updateConnectionStatus(connectionElement, "failed");
+            throw err;
+          }
+          console.log("Set remote description");
+          retries = 0;
+          if (!established) {
+            established = true;
+            resolveAnswered();
+          }
+          break;
+        case "offer":
+          // ICE restart offered by the server. If our own restart offer
+          // crossed it, the server rolls back and answers ours instead.
+          if (pc.signalingState !== "stable") return;
+          await pc.setRemoteDescription({ type: "offer", sdp: msg.sdp });
+          await pc.setLocalDescription();
+          send({ type: "answer", sdp: pc.localDescription?.sdp });
+          break;
+        case "candidate":
+          if (msg.candidate) {
+            await pc.addIceCandidate(msg.candidate);
+          }
+          break;
+        case "close":
+          console.log("Server closed the session:", msg.reason);
+          break;
+        case "error":
+          console.warn("Signaling error:", msg.reason);
+          break;
+      }
+    };
 
-    console.log("Offer SDP (ICE complete):\n", pc.localDescription?.sdp);
+    // Messages are handled one at a time, so candidates follow their description
+    const attach = (socket: WebSocket) => {
+      ws = socket;
+      let queue = Promise.resolve();
+      socket.onmessage = (event) => {
+        const msg = JSON.parse(event.data) as SignalMessage;
+        if (msg.type === "close") {
+          // Kept at once: the socket closes right after, possibly before the queue gets here
+          closeReason = msg.reason ?? "";
+        }
+        queue = queue
+          .then(() => handleMessage(msg))
+          .catch((err) => console.error(`Signaling ${msg.type} failed:`, err));
+      };
+      socket.onclose = () => {
+        if (hungUp || socket !== ws) return;
+        if (!established) {
+          rejectAnswered(new Error(closeReason || "Signaling closed"));
+          return;
+        }
+        reconnect();
+      };
+    };
 
-    const res = await fetch(`${url}/offer`, {
-      method: "POST",
-      body: JSON.stringify(pc.localDescription),
-      headers: { "Content-Type": "application/json" },
-    });
+    // Reopen the signaling socket and offer an ICE restart on it, keeping the
+    // peer connection, so the video resumes without a new session
+    const reconnect = async () => {
+      while (retries < MAX_SIGNALING_RETRIES) {
+        const attempt = ++retries;
+        updateConnectionStatus(connectionElement, "connecting", {
+          isReconnecting: true,
+          attemptNumber: attempt,
+        });
+        await new Promise((resolve) =>
+          setTimeout(resolve, Math.min(1000 * 2 ** (attempt - 1), 10000)),
+        );
+        if (hungUp) return;
+        try {
+          const next = await openSignaling(url);
+          // Fresh TURN credentials
+          pc.setConfiguration({
+            ...pc.getConfiguration(),
+            iceServers: next.iceServers,
+          });
+          attach(next.ws);
+          closeReason = "";
+          const offer = await pc.createOffer({ iceRestart: true });
+          await pc.setLocalDescription(offer);
+          send({ type: "offer", sdp: offer.sdp });
+          console.log("Signaling reconnected, ICE restart offered");
+          return;
+        } catch (err) {
+          console.warn(`Signaling reconnect attempt ${attempt} failed:`, err);
+        }
+      }
+      if (!hungUp) {
+        updateConnectionStatus(connectionElement, "failed");
+      }
+    };
 
-    if (!res.ok) {
-      throw new Error(`HTTP ${res.status}: ${res.statusText}`);
-    }
+    attach(ws);
 
-    const answer = await res.json();
-    console.log("Received answer from server:", answer);
-    await pc.setRemoteDescription(answer);
-    console.log("Set remote description");
+    // Sent at once: candidates follow as they are gathered
+    const offer = await pc.createOffer();
+    await pc.setLocalDescription(offer);
+    send({ type: "offer", sdp: offer.sdp });
+    await answered.catch((err) => {
+      pc.close();
+      throw err;
+    });
 
-    // Return the peer connection for lifecycle management
-    return pc;
+    // Return the connection for lifecycle management
+    return {
+      pc,
+      close: () => {
+        hungUp = true;
+        send({ type: "close" });
+        ws.close();
+        pc.close();
+      },
+    };
   } catch (err) {
     console.error("Error:", err);
     if (err instanceof Error) {
@@ -10,6 +10,7 @@ import {
   startRecording,
   stopRecording,
 } from "./recording";
+import type { RecordingStatus } from "./recording";
 import { RecordingsPanel } from "./recordings-panel";
 import { getStorage, setStorage } from "./storage";
 
@@ -147,16 +148,14 @@ let recordingsPanel: RecordingsPanel | null = null;
 
 function updateRecordButton(recording: boolean, finalizing = false): void {
   if (!recordButton) return;
-  recordButton.ariaPressed = String(recording || finalizing);
+  recordButton.ariaPressed = String(recording);
   recordButton.classList.toggle("recording", recording);
-  recordButton.disabled = finalizing; // Disable button during finalization
+  // Earlier recordings convert in the background; a new one can start meanwhile
+  recordButton.title =
+    finalizing && !recording ? "Finalizing previous recording..." : "";
   const label = recordButton.querySelector(".record-label");
-  if (label) {
-    if (finalizing) {
-      label.textContent = "Finalizing MP4...";
-    } else if (!recording) {
-      label.textContent = "Record";
-    }
+  if (label && !recording) {
+    label.textContent = "Record";
   }
 }
 
@@ -224,17 +223,20 @@ async function initRecording(): Promise<void> {
     const updateForCurrentCamera = async () => {
       const currentCamera = carousel.getCamera(carousel.getCurrentIndex());
       const status = await getRecordingStatus(currentCamera.endpoint).catch(
-        () => ({
+        (): RecordingStatus => ({
           available: false,
           recording: false,
           finalizing: false,
+          maxDurationMs: 0,
         }),
       );
 
-      // Hide/show button based on current camera's support
-      recordButton.style.display = status.available ? "" : "none";
+      // Hide/show button based on current camera's support; a camera
+      // recording continuously can't be started or stopped by hand
+      const manual = status.available && status.mode !== "continuous";
+      recordButton.style.display = manual ? "" : "none";
 
-      if (status.available) {
+      if (manual) {
         updateRecordButton(status.recording, status.finalizing);
         if (status.recording || status.finalizing) {
           startStatusPolling();
@@ -259,9 +261,9 @@ async function initRecording(): Promise<void> {
         const currentStatus = await getRecordingStatus(currentEndpoint);
 
         if (currentStatus.recording) {
-          await stopRecording(currentEndpoint);
-          // Don't update button yet - wait for status polling to show finalization
-          startStatusPolling(); // Continue polling to show "Finalizing MP4..."
+          const status = await stopRecording(currentEndpoint);
+          updateRecordButton(false, status.finalizing);
+          startStatusPolling(); // Continue polling until finalization is done
         } else {
           await startRecording(currentEndpoint);
           updateRecordButton(true);
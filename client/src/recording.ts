@@ -1,15 +1,32 @@
+import { authHeaders, withAccessToken } from "./auth";
+
 // Recording status from server
 export interface RecordingStatus {
   available: boolean;
   recording: boolean;
-  finalizing: boolean; // True during MP4 conversion after recording stops
+  finalizing: boolean; // True while earlier recordings are being converted to MP4
+  jobs?: FinalizeJob[]; // Those conversions
   unavailableReason?: string; // Reason why recording is unavailable (if available is false)
   filePath?: string;
   startTime?: number;
   durationMs?: number;
   maxDurationMs: number; // Max recording duration in ms
+  mode?: "manual" | "continuous"; // Continuous mode records segments around the clock
+  segmentMs?: number; // Segment length in continuous mode
   bytesWritten?: number;
   framesWritten?: number;
+  startedBy?: string; // Who started the recording, when authentication is enabled
+}
+
+// Background conversion of a finished recording
+export interface FinalizeJob {
+  id: number;
+  filename: string;
+  state: "queued" | "converting" | "done" | "failed";
+  error?: string;
+  queuedAt: number;
+  startedAt?: number;
+  finishedAt?: number;
 }
 
 // Recording file info for listings
@@ -18,6 +35,8 @@ export interface RecordingFile {
   sizeBytes: number;
   createdAt: number;
   durationMs: number;
+  startedBy?: string;
+  recording?: boolean; // Still being written
 }
 
 // Get current recording status
@@ -26,6 +45,7 @@ export async function getRecordingStatus(
 ): Promise<RecordingStatus> {
   const response = await fetch(`${endpoint}/record/status`, {
     method: "GET",
+    headers: authHeaders(),
   });
   if (!response.ok) {
     throw new Error(`Failed to get recording status: ${response.statusText}`);
@@ -39,6 +59,7 @@ export async function startRecording(
 ): Promise<RecordingStatus> {
   const response = await fetch(`${endpoint}/record/start`, {
     method: "POST",
+    headers: authHeaders(),
   });
   if (!response.ok) {
     const error = await response.text();
@@ -55,6 +76,7 @@ export async function stopRecording(
 ): Promise<RecordingStatus> {
   const response = await fetch(`${endpoint}/record/stop`, {
     method: "POST",
+    headers: authHeaders(),
   });
   if (!response.ok) {
     const error = await response.text();
@@ -71,6 +93,7 @@ export async function listRecordings(
 ): Promise<RecordingFile[]> {
   const response = await fetch(`${endpoint}/record/list`, {
     method: "GET",
+    headers: authHeaders(),
   });
   if (!response.ok) {
     throw new Error(`Failed to list recordings: ${response.statusText}`);
@@ -81,7 +104,9 @@ export async function listRecordings(
 
 // Get download URL for a recording
 export function getDownloadUrl(endpoint: string, filename: string): string {
-  return `${endpoint}/record/download/${encodeURIComponent(filename)}`;
+  return withAccessToken(
+    `${endpoint}/record/download/${encodeURIComponent(filename)}`,
+  );
 }
 
 // Format duration for display (MM:SS or HH:MM:SS)
@@ -130,10 +155,11 @@ export function formatDate(timestamp: number): string {
   return `${month} ${day}, ${hours}:${minutes}`;
 }
 
-// Parse recording filename to extract date (recording_20260131_143052.mp4)
+// Parse recording filename to extract date (recording_20260131_143052.mp4,
+// or recording_20260131_143052_2.mp4 for a second recording in the same second)
 export function parseRecordingDate(filename: string): Date | null {
   const match = filename.match(
-    /recording_(\d{4})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})\.mp4/,
+    /recording_(\d{4})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})(?:_\d+)?\.mp4/,
   );
   if (!match) return null;
 
@@ -1,3 +1,15 @@
+#!/bin/bash
+set -euo pipefail
+
+# EMBED_CLIENT=1 builds the web client into the binary (serve it with client_embedded = true)
+TAGS=""
+if [ "${EMBED_CLIENT:-}" = "1" ]; then
+    (cd client && npm run build)
+    rm -rf server/internal/webclient
+    cp -r client/dist server/internal/webclient
+    TAGS="-tags embedclient"
+fi
+
 cd server
-GOOS=linux GOARCH=arm64 go build -o ../builds/petwebrtc-arm64 .
-GOOS=linux GOARCH=arm GOARM=7 go build -o ../builds/petwebrtc-arm32 .
\ No newline at end of file
+GOOS=linux GOARCH=arm64 go build $TAGS -o ../builds/petwebrtc-arm64 .
+GOOS=linux GOARCH=arm GOARM=7 go build $TAGS -o ../builds/petwebrtc-arm32 .
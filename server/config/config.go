@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,16 +20,177 @@ type ServerConfig struct {
 	Height                     int
 	Framerate                  int
 	Rotation                   int
-	Bitrate                    int // Optional: H264 bitrate in bits/sec (e.g., 1000000 = 1Mbps). If 0, rpicam-vid chooses automatically.
+	Bitrate                    int    // Optional: H264 bitrate in bits/sec (e.g., 1000000 = 1Mbps). If 0, rpicam-vid chooses automatically.
+	Source                     string // Video source: rpicam (default), exec, pipe, tcp or file
+	CameraCmd                  string // Shell command for the exec source, must write Annex-B H264 to stdout
+	SourcePath                 string // FIFO path for the pipe source, .h264 file for the file source
+	SourceAddr                 string // Listen address for the tcp source (e.g. ":5000")
+	SourceLoop                 bool   // Restart the file source at EOF (default true)
 	CorsOrigin                 string
-	RecordingDir               string // Optional: directory for recording files (must exist and be writable)
-	RecordingUnavailableReason string // Reason why recording is unavailable (if RecordingDir is empty)
-	RecordingSkipConversion    bool   // Optional, if ffmpeg finalisation should be ignored
-	RecordingMaxMinutes        int    // Optional: max recording duration in minutes (1-480, default 60)
+	NackBufferSize             int         // RTP packets kept per viewer for NACK retransmission (power of two, 0 disables)
+	ICEServers                 []ICEServer // STUN/TURN servers for viewer connections (ice_server, may be repeated)
+	ICENAT1To1IPs              []string    // Public IPs to advertise when behind a 1:1 NAT
+	ICENAT1To1Type             string      // "host" replaces host candidates with the public IPs, "srflx" adds them
+	ICEUDPPortMin              int         // Optional: ephemeral UDP port range for ICE (both or neither)
+	ICEUDPPortMax              int
+	ICEInterfaces              []string // Optional: only gather candidates on these network interfaces
+	ICEUDPMuxPort              int      // Optional: serve all ICE UDP traffic on this single port (0 = per-connection ports)
+	ICETCPPort                 int      // Optional: accept ICE-TCP on this port (0 = disabled)
+	TURNPort                   int      // Optional: run the embedded TURN server on this UDP and TCP port (0 = disabled)
+	TURNPublicIP               string   // Relay address handed to clients (default: first ice_nat1to1_ips entry, else detected)
+	TURNRealm                  string   // TURN realm (default "webrtc-ipcam")
+	TURNSecret                 string   // Shared secret for short-lived TURN credentials (random per start if empty)
+	TURNRelayPortMin           int      // Optional: UDP port range for relayed traffic (both or neither)
+	TURNRelayPortMax           int
+	TURNCredentialMinutes      int              // Lifetime of TURN credentials given to clients (default 720)
+	AuthTokens                 []AuthCredential // Static bearer tokens (auth_token = name:token role=..., repeatable)
+	AuthUsers                  []AuthCredential // HTTP Basic users with bcrypt password hashes (auth_user = name:hash role=..., repeatable)
+	AuthJWTSecret              string           // Shared secret for HS256/HS384/HS512 JWTs (auth_jwt_secret)
+	AuthRealm                  string           // HTTP Basic realm (default "PetWebRTC")
+	ShareLinksFile             string           // Optional: file that keeps share links across restarts
+	TLS                        bool             // Serve HTTPS on addr (tls = true, implied by tls_cert)
+	TLSCert                    string           // PEM certificate chain; a self-signed one is generated when empty
+	TLSKey                     string           // PEM private key for TLSCert
+	TLSSelfSigned              bool             // Set by Validate when the certificate is generated rather than provided
+	TLSSelfSignedDir           string           // Where the self-signed certificate is kept (default: beside server.conf)
+	TLSHosts                   []string         // Extra host names and IPs for the self-signed certificate
+	HTTPRedirectPort           int              // Optional: plain HTTP port that redirects to HTTPS (0 = disabled)
+	ClientDir                  string           // Optional: serve the built web client from this directory
+	ClientEmbedded             bool             // Serve the web client compiled into the binary (build tag embedclient)
+	CameraTitle                string           // Title of this server's camera in /cameras (default: host name)
+	Cameras                    []Camera         // Other cameras listed in /cameras (camera = endpoint title, repeatable)
+	RecordingDir               string           // Optional: directory for recording files (must exist and be writable)
+	RecordingUnavailableReason string           // Reason why recording is unavailable (if RecordingDir is empty)
+	RecordingSkipConversion    bool             // Optional: keep the raw .h264 instead of muxing an MP4
+	RecordingTranscode         bool             // Optional: re-encode with ffmpeg (libx264) instead of copying the stream into the MP4
+	RecordingMaxMinutes        int              // Optional: max recording duration in minutes (1-480, default 60)
+	RecordingMode              string           // Optional: "manual" (start/stop on request, default) or "continuous" (segments around the clock)
+	RecordingSegmentMinutes    int              // Optional: segment length in continuous mode (1-60, default 5)
+	RecordingPrerollSeconds    int              // Optional: seconds of video kept in memory and prepended to a manual recording (0-60, default 5, 0 disables)
+	RecordingPrerollMaxMB      int              // Optional: memory cap of that history in MB (1-64, default 8)
+}
+
+// ICEServer is a STUN or TURN server, configured as
+// `ice_server = turn:turn.example.com:3478,turns:turn.example.com:5349 username=user credential=secret`
+type ICEServer struct {
+	URLs       []string
+	Username   string
+	Credential string
+}
+
+// Camera is another camera server shown by the web client, configured as
+// `camera = https://backyard.local:8765 Backyard`
+type Camera struct {
+	Endpoint string `json:"endpoint"`
+	Title    string `json:"title"`
+}
+
+// AuthCredential is a named bearer token or a user with a bcrypt password hash
+type AuthCredential struct {
+	Name   string
+	Secret string
+	Role   string // viewer, recorder or admin (default viewer)
+}
+
+// AuthRoles are the roles a credential can have, from least to most privileged
+var AuthRoles = []string{"viewer", "recorder", "admin"}
+
+// AuthEnabled reports whether any authentication method is configured
+func (c *ServerConfig) AuthEnabled() bool {
+	return len(c.AuthTokens) > 0 || len(c.AuthUsers) > 0 || c.AuthJWTSecret != ""
+}
+
+// parseAuthCredential parses `name:secret role=recorder`; a token without a name is named "token"
+func parseAuthCredential(val string, requireName bool) (AuthCredential, error) {
+	fields := strings.Fields(val)
+	if len(fields) == 0 {
+		return AuthCredential{}, fmt.Errorf("empty value")
+	}
+	name, secret, found := strings.Cut(fields[0], ":")
+	if !found {
+		if requireName {
+			return AuthCredential{}, fmt.Errorf("expected name:hash")
+		}
+		name, secret = "token", fields[0]
+	}
+	if name == "" || secret == "" {
+		return AuthCredential{}, fmt.Errorf("empty name or secret")
+	}
+
+	credential := AuthCredential{Name: name, Secret: secret, Role: "viewer"}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if key != "role" {
+			return AuthCredential{}, fmt.Errorf("unknown field %q", key)
+		}
+		if !slices.Contains(AuthRoles, value) {
+			return AuthCredential{}, fmt.Errorf("unknown role %q (expected viewer, recorder or admin)", value)
+		}
+		credential.Role = value
+	}
+	return credential, nil
+}
+
+// parseCamera parses the value of a camera line: the server's URL followed by its title
+func parseCamera(val string) (Camera, error) {
+	fields := strings.Fields(val)
+	if len(fields) == 0 {
+		return Camera{}, fmt.Errorf("empty camera")
+	}
+	endpoint := fields[0]
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return Camera{}, fmt.Errorf("invalid camera URL %q", endpoint)
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	title := strings.Join(fields[1:], " ")
+	if title == "" {
+		title = strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	}
+	return Camera{Endpoint: endpoint, Title: title}, nil
+}
+
+// parseICEServer parses the value of an ice_server line: comma-separated URLs
+// followed by optional username= and credential= fields
+func parseICEServer(val string) (ICEServer, error) {
+	fields := strings.Fields(val)
+	if len(fields) == 0 {
+		return ICEServer{}, fmt.Errorf("empty ice_server")
+	}
+	var server ICEServer
+	for _, url := range strings.Split(fields[0], ",") {
+		if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "stuns:") &&
+			!strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+			return ICEServer{}, fmt.Errorf("invalid ICE server URL %q", url)
+		}
+		server.URLs = append(server.URLs, url)
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "username":
+			server.Username = value
+		case "credential":
+			server.Credential = value
+		default:
+			return ICEServer{}, fmt.Errorf("unknown ice_server field %q", key)
+		}
+	}
+	return server, nil
+}
+
+// splitList splits a comma-separated config value, dropping empty entries
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // ParseConfig loads configuration from the given file path (TOML-like, key=value per line).
-// If camera_cmd is not set, it is auto-generated from width, height, framerate, and rotation.
+// With the default rpicam source, the camera command is generated from width, height, framerate, and rotation.
 func ParseConfig(path string) *ServerConfig {
 	// Defaults
 	conf := &ServerConfig{
@@ -35,9 +199,21 @@ func ParseConfig(path string) *ServerConfig {
 		Height:                  720,
 		Framerate:               30,
 		Rotation:                180,
+		Source:                  "rpicam",
+		SourceLoop:              true,
 		CorsOrigin:              "*",
+		NackBufferSize:          512,
+		ICENAT1To1Type:          "host",
+		TURNRealm:               "webrtc-ipcam",
+		TURNCredentialMinutes:   720,
+		AuthRealm:               "PetWebRTC",
+		TLSSelfSignedDir:        filepath.Dir(path),
 		RecordingSkipConversion: false,
 		RecordingMaxMinutes:     60,
+		RecordingMode:           "manual",
+		RecordingSegmentMinutes: 5,
+		RecordingPrerollSeconds: 5,
+		RecordingPrerollMaxMB:   8,
 	}
 
 	f, err := os.Open(path)
@@ -84,16 +260,144 @@ func ParseConfig(path string) *ServerConfig {
 				if v, err := strconv.Atoi(val); err == nil {
 					conf.Bitrate = v
 				}
+			case "source":
+				conf.Source = val
+			case "camera_cmd":
+				conf.CameraCmd = val
+			case "source_path":
+				conf.SourcePath = val
+			case "source_addr":
+				conf.SourceAddr = val
+			case "source_loop":
+				conf.SourceLoop = val == "true"
 			case "cors_origin":
 				conf.CorsOrigin = val
+			case "nack_buffer":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.NackBufferSize = v
+				}
+			case "ice_server":
+				server, err := parseICEServer(val)
+				if err != nil {
+					log.Printf("WARNING: Ignoring ice_server: %v", err)
+					continue
+				}
+				conf.ICEServers = append(conf.ICEServers, server)
+			case "ice_nat1to1_ips":
+				conf.ICENAT1To1IPs = splitList(val)
+			case "ice_nat1to1_type":
+				conf.ICENAT1To1Type = val
+			case "ice_udp_port_min":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.ICEUDPPortMin = v
+				}
+			case "ice_udp_port_max":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.ICEUDPPortMax = v
+				}
+			case "ice_interfaces":
+				conf.ICEInterfaces = splitList(val)
+			case "ice_udp_mux_port":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.ICEUDPMuxPort = v
+				}
+			case "ice_tcp_port":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.ICETCPPort = v
+				}
+			case "turn_port":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.TURNPort = v
+				}
+			case "turn_public_ip":
+				conf.TURNPublicIP = val
+			case "turn_realm":
+				conf.TURNRealm = val
+			case "turn_secret":
+				conf.TURNSecret = val
+			case "turn_relay_port_min":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.TURNRelayPortMin = v
+				}
+			case "turn_relay_port_max":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.TURNRelayPortMax = v
+				}
+			case "turn_credential_minutes":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.TURNCredentialMinutes = v
+				}
+			case "auth_token":
+				token, err := parseAuthCredential(val, false)
+				if err != nil {
+					log.Printf("WARNING: Ignoring auth_token: %v", err)
+					continue
+				}
+				conf.AuthTokens = append(conf.AuthTokens, token)
+			case "auth_user":
+				user, err := parseAuthCredential(val, true)
+				if err != nil {
+					log.Printf("WARNING: Ignoring auth_user: %v", err)
+					continue
+				}
+				conf.AuthUsers = append(conf.AuthUsers, user)
+			case "auth_jwt_secret":
+				conf.AuthJWTSecret = val
+			case "auth_realm":
+				conf.AuthRealm = val
+			case "share_links_file":
+				conf.ShareLinksFile = val
+			case "tls":
+				conf.TLS = val == "true"
+			case "tls_cert":
+				conf.TLSCert = val
+			case "tls_key":
+				conf.TLSKey = val
+			case "tls_self_signed_dir":
+				conf.TLSSelfSignedDir = val
+			case "tls_hosts":
+				conf.TLSHosts = splitList(val)
+			case "http_redirect_port":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.HTTPRedirectPort = v
+				}
+			case "client_dir":
+				conf.ClientDir = val
+			case "client_embedded":
+				conf.ClientEmbedded = val == "true"
+			case "camera_title":
+				conf.CameraTitle = val
+			case "camera":
+				camera, err := parseCamera(val)
+				if err != nil {
+					log.Printf("WARNING: Ignoring camera: %v", err)
+					continue
+				}
+				conf.Cameras = append(conf.Cameras, camera)
 			case "recording_dir":
 				conf.RecordingDir = val
 			case "recording_skip_conversion":
 				conf.RecordingSkipConversion = val == "true"
+			case "recording_transcode":
+				conf.RecordingTranscode = val == "true"
 			case "recording_max_minutes":
 				if v, err := strconv.Atoi(val); err == nil {
 					conf.RecordingMaxMinutes = v
 				}
+			case "recording_mode":
+				conf.RecordingMode = val
+			case "recording_segment_minutes":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.RecordingSegmentMinutes = v
+				}
+			case "recording_preroll_seconds":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.RecordingPrerollSeconds = v
+				}
+			case "recording_preroll_max_mb":
+				if v, err := strconv.Atoi(val); err == nil {
+					conf.RecordingPrerollMaxMB = v
+				}
 			}
 		}
 	}
@@ -104,14 +408,14 @@ func ParseConfig(path string) *ServerConfig {
 	return conf
 }
 
-// checkFFmpegAvailable checks if ffmpeg is available in PATH
+// checkFFmpegAvailable checks if ffmpeg is available in PATH, when recording_transcode needs it
 func checkFFmpegAvailable(c *ServerConfig) error {
-	if c.RecordingSkipConversion == true {
+	if c.RecordingSkipConversion || !c.RecordingTranscode {
 		return nil
 	}
 	cmd := exec.Command("ffmpeg", "-version")
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("ffmpeg not found in PATH (required for MP4 recording)")
+		return fmt.Errorf("ffmpeg not found in PATH (required for recording_transcode)")
 	}
 	return nil
 }
@@ -147,6 +451,26 @@ func (c *ServerConfig) Validate() {
 		c.Rotation = 180
 	}
 
+	// Validate video source
+	validSources := map[string]bool{"rpicam": true, "exec": true, "pipe": true, "tcp": true, "file": true}
+	if !validSources[c.Source] {
+		log.Printf("WARNING: Invalid source %q, using default rpicam", c.Source)
+		c.Source = "rpicam"
+	}
+
+	// Validate NACK buffer (the responder needs a power of two up to 32768)
+	if c.NackBufferSize < 0 || c.NackBufferSize > 32768 || c.NackBufferSize&(c.NackBufferSize-1) != 0 {
+		log.Printf("WARNING: Invalid nack_buffer %d (must be a power of two up to 32768), using default 512", c.NackBufferSize)
+		c.NackBufferSize = 512
+	}
+
+	c.validateICE()
+	c.validateTURN()
+
+	c.validateAuth()
+	c.validateTLS()
+	c.validateClient()
+
 	// Warn about insecure CORS setting
 	if c.CorsOrigin == "*" {
 		log.Println("WARNING: CORS origin set to '*' - this is insecure for production")
@@ -158,6 +482,23 @@ func (c *ServerConfig) Validate() {
 		c.RecordingMaxMinutes = 60
 	}
 
+	if c.RecordingMode != "manual" && c.RecordingMode != "continuous" {
+		log.Printf("WARNING: Invalid recording_mode %q, using manual", c.RecordingMode)
+		c.RecordingMode = "manual"
+	}
+	if c.RecordingSegmentMinutes < 1 || c.RecordingSegmentMinutes > 60 {
+		log.Printf("WARNING: Invalid recording_segment_minutes %d, using default 5", c.RecordingSegmentMinutes)
+		c.RecordingSegmentMinutes = 5
+	}
+	if c.RecordingPrerollSeconds < 0 || c.RecordingPrerollSeconds > 60 {
+		log.Printf("WARNING: Invalid recording_preroll_seconds %d, using default 5", c.RecordingPrerollSeconds)
+		c.RecordingPrerollSeconds = 5
+	}
+	if c.RecordingPrerollMaxMB < 1 || c.RecordingPrerollMaxMB > 64 {
+		log.Printf("WARNING: Invalid recording_preroll_max_mb %d, using default 8", c.RecordingPrerollMaxMB)
+		c.RecordingPrerollMaxMB = 8
+	}
+
 	// Validate recording directory if set
 	if c.RecordingDir != "" {
 		c.validateRecordingDir()
@@ -167,6 +508,175 @@ func (c *ServerConfig) Validate() {
 	}
 }
 
+// validateAuth drops unusable credentials and warns about weak ones
+func (c *ServerConfig) validateAuth() {
+	users := c.AuthUsers[:0]
+	for _, user := range c.AuthUsers {
+		// bcrypt hashes, as made by `htpasswd -nbB` ($2y$) or Go's bcrypt ($2a$)
+		if !strings.HasPrefix(user.Secret, "$2") {
+			log.Printf("WARNING: auth_user %q does not have a bcrypt hash, ignoring", user.Name)
+			continue
+		}
+		users = append(users, user)
+	}
+	c.AuthUsers = users
+
+	for _, token := range c.AuthTokens {
+		if len(token.Secret) < 16 {
+			log.Printf("WARNING: auth_token %q is shorter than 16 characters and easy to guess", token.Name)
+		}
+	}
+	if c.AuthJWTSecret != "" && len(c.AuthJWTSecret) < 32 {
+		log.Println("WARNING: auth_jwt_secret is shorter than 32 characters and easy to brute force")
+	}
+	if c.AuthRealm == "" {
+		c.AuthRealm = "PetWebRTC"
+	}
+
+	if !c.AuthEnabled() {
+		log.Println("WARNING: No auth_token, auth_user or auth_jwt_secret configured - every endpoint is open to anyone who can reach the port")
+	}
+}
+
+// validateTLS settles where the certificate comes from and checks the redirect port
+func (c *ServerConfig) validateTLS() {
+	if c.TLSCert != "" || c.TLSKey != "" {
+		c.TLS = true
+	}
+	if c.TLS {
+		switch {
+		case c.TLSCert == "" && c.TLSKey == "":
+			c.TLSSelfSigned = true
+			c.TLSCert = filepath.Join(c.TLSSelfSignedDir, "selfsigned.crt")
+			c.TLSKey = filepath.Join(c.TLSSelfSignedDir, "selfsigned.key")
+		case c.TLSCert == "" || c.TLSKey == "":
+			log.Println("WARNING: tls_cert and tls_key must be set together, using a self-signed certificate")
+			c.TLSSelfSigned = true
+			c.TLSCert = filepath.Join(c.TLSSelfSignedDir, "selfsigned.crt")
+			c.TLSKey = filepath.Join(c.TLSSelfSignedDir, "selfsigned.key")
+		}
+	} else if c.AuthEnabled() {
+		log.Println("WARNING: Authentication is enabled without TLS - passwords and tokens are sent in the clear")
+	}
+
+	if c.HTTPRedirectPort != 0 {
+		switch {
+		case !c.TLS:
+			log.Println("WARNING: http_redirect_port needs TLS, ignoring")
+			c.HTTPRedirectPort = 0
+		case c.HTTPRedirectPort < 0 || c.HTTPRedirectPort > 65535 || c.HTTPRedirectPort == c.Addr ||
+			c.HTTPRedirectPort == c.TURNPort || c.HTTPRedirectPort == c.ICETCPPort:
+			log.Printf("WARNING: Invalid or conflicting http_redirect_port %d, redirect disabled", c.HTTPRedirectPort)
+			c.HTTPRedirectPort = 0
+		}
+	}
+}
+
+// validateClient checks the web client directory and names this camera
+func (c *ServerConfig) validateClient() {
+	if c.ClientDir != "" {
+		if _, err := os.Stat(filepath.Join(c.ClientDir, "index.html")); err != nil {
+			log.Printf("WARNING: client_dir %s has no index.html (build the client with npm run build), not serving the web client", c.ClientDir)
+			c.ClientDir = ""
+		} else if c.ClientEmbedded {
+			log.Println("WARNING: Both client_dir and client_embedded set, serving client_dir")
+			c.ClientEmbedded = false
+		}
+	}
+
+	if c.CameraTitle == "" {
+		c.CameraTitle = "Camera"
+		if hostname, err := os.Hostname(); err == nil && hostname != "" {
+			c.CameraTitle = hostname
+		}
+	}
+}
+
+// validateICE checks the ICE networking options, disabling the ones that cannot work
+func (c *ServerConfig) validateICE() {
+	if c.ICENAT1To1Type != "host" && c.ICENAT1To1Type != "srflx" {
+		log.Printf("WARNING: Invalid ice_nat1to1_type %q, using host", c.ICENAT1To1Type)
+		c.ICENAT1To1Type = "host"
+	}
+	for _, ip := range c.ICENAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			log.Printf("WARNING: Invalid ice_nat1to1_ips entry %q, NAT 1:1 disabled", ip)
+			c.ICENAT1To1IPs = nil
+			break
+		}
+	}
+	if len(c.ICENAT1To1IPs) > 0 && c.ICENAT1To1Type == "srflx" && c.hasSTUNServer() {
+		log.Println("WARNING: ice_nat1to1_type srflx cannot be combined with STUN servers, using host")
+		c.ICENAT1To1Type = "host"
+	}
+
+	if c.ICEUDPPortMin != 0 || c.ICEUDPPortMax != 0 {
+		if c.ICEUDPPortMin < 1 || c.ICEUDPPortMax > 65535 || c.ICEUDPPortMin > c.ICEUDPPortMax {
+			log.Printf("WARNING: Invalid ICE UDP port range %d-%d, using ephemeral ports", c.ICEUDPPortMin, c.ICEUDPPortMax)
+			c.ICEUDPPortMin, c.ICEUDPPortMax = 0, 0
+		}
+	}
+	if c.ICEUDPMuxPort < 0 || c.ICEUDPMuxPort > 65535 {
+		log.Printf("WARNING: Invalid ice_udp_mux_port %d, UDP mux disabled", c.ICEUDPMuxPort)
+		c.ICEUDPMuxPort = 0
+	}
+	if c.ICEUDPMuxPort != 0 && c.ICEUDPPortMin != 0 {
+		log.Println("WARNING: ice_udp_port_min/max are ignored when ice_udp_mux_port is set")
+	}
+	// Server-reflexive candidates are gathered on their own ephemeral ports, outside the mux
+	if c.ICEUDPMuxPort != 0 && len(c.ICENAT1To1IPs) > 0 && c.ICENAT1To1Type == "srflx" {
+		log.Println("WARNING: ice_nat1to1_type srflx would bypass ice_udp_mux_port, using host")
+		c.ICENAT1To1Type = "host"
+	}
+	if c.ICEUDPMuxPort != 0 && c.hasSTUNServer() && len(c.ICENAT1To1IPs) == 0 {
+		log.Println("WARNING: STUN candidates use ephemeral ports outside ice_udp_mux_port; set ice_nat1to1_ips to advertise the forwarded port instead")
+	}
+	if c.ICETCPPort < 0 || c.ICETCPPort > 65535 || (c.ICETCPPort != 0 && c.ICETCPPort == c.Addr) {
+		log.Printf("WARNING: Invalid ice_tcp_port %d, ICE-TCP disabled", c.ICETCPPort)
+		c.ICETCPPort = 0
+	}
+}
+
+// validateTURN checks the embedded TURN server options, disabling it if its port is unusable
+func (c *ServerConfig) validateTURN() {
+	if c.TURNPort == 0 {
+		return
+	}
+	if c.TURNPort < 0 || c.TURNPort > 65535 || c.TURNPort == c.Addr || c.TURNPort == c.ICETCPPort || c.TURNPort == c.ICEUDPMuxPort {
+		log.Printf("WARNING: Invalid or conflicting turn_port %d, TURN server disabled", c.TURNPort)
+		c.TURNPort = 0
+		return
+	}
+	if c.TURNPublicIP != "" && net.ParseIP(c.TURNPublicIP) == nil {
+		log.Printf("WARNING: Invalid turn_public_ip %q, detecting the relay address instead", c.TURNPublicIP)
+		c.TURNPublicIP = ""
+	}
+	if c.TURNRelayPortMin != 0 || c.TURNRelayPortMax != 0 {
+		if c.TURNRelayPortMin < 1 || c.TURNRelayPortMax > 65535 || c.TURNRelayPortMin > c.TURNRelayPortMax {
+			log.Printf("WARNING: Invalid TURN relay port range %d-%d, using ephemeral ports", c.TURNRelayPortMin, c.TURNRelayPortMax)
+			c.TURNRelayPortMin, c.TURNRelayPortMax = 0, 0
+		}
+	}
+	if c.TURNCredentialMinutes < 1 {
+		log.Printf("WARNING: Invalid turn_credential_minutes %d, using default 720", c.TURNCredentialMinutes)
+		c.TURNCredentialMinutes = 720
+	}
+	if c.TURNRealm == "" {
+		c.TURNRealm = "webrtc-ipcam"
+	}
+}
+
+func (c *ServerConfig) hasSTUNServer() bool {
+	for _, server := range c.ICEServers {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, "stun") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // validateRecordingDir validates the recording directory, retrying if the directory
 // is not yet accessible (e.g. NFS mount not ready at boot). Retries up to 5 times
 // with 2-second intervals before giving up.
@@ -177,7 +687,18 @@ func (c *ServerConfig) validateRecordingDir() {
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		reason := c.tryRecordingDir()
 		if reason == "" {
-			log.Printf("Recording enabled: %s (using ffmpeg for MP4 muxing)", c.RecordingDir)
+			muxer := "fragmented MP4"
+			switch {
+			case c.RecordingSkipConversion:
+				muxer = "raw .h264"
+			case c.RecordingTranscode:
+				muxer = "ffmpeg re-encode"
+			}
+			if c.RecordingMode == "continuous" {
+				log.Printf("Recording enabled: %s (%s, continuous in %d-minute segments)", c.RecordingDir, muxer, c.RecordingSegmentMinutes)
+			} else {
+				log.Printf("Recording enabled: %s (%s)", c.RecordingDir, muxer)
+			}
 			c.RecordingUnavailableReason = ""
 			return
 		}
@@ -213,7 +734,7 @@ func (c *ServerConfig) tryRecordingDir() string {
 	f.Close()
 	os.Remove(testFile)
 
-	// Check if ffmpeg is available (required for MP4 muxing)
+	// Check if ffmpeg is available (only needed to re-encode)
 	if err := checkFFmpegAvailable(c); err != nil {
 		return fmt.Sprintf("ffmpeg not available: %v", err)
 	}
@@ -226,11 +747,34 @@ func (c *ServerConfig) String() string {
 	recording := "disabled"
 	if c.RecordingDir != "" {
 		recording = c.RecordingDir
+		if c.RecordingMode == "continuous" {
+			recording += " (continuous)"
+		}
 	}
 	bitrate := "auto"
 	if c.Bitrate > 0 {
 		bitrate = fmt.Sprintf("%dkbps", c.Bitrate/1000)
 	}
-	return fmt.Sprintf("Port=%d, Resolution=%dx%d@%dfps, Rotation=%d°, Bitrate=%s, CORS=%s, Recording=%s",
-		c.Addr, c.Width, c.Height, c.Framerate, c.Rotation, bitrate, c.CorsOrigin, recording)
+	var auth []string
+	if len(c.AuthTokens) > 0 {
+		auth = append(auth, fmt.Sprintf("%d tokens", len(c.AuthTokens)))
+	}
+	if len(c.AuthUsers) > 0 {
+		auth = append(auth, fmt.Sprintf("%d basic users", len(c.AuthUsers)))
+	}
+	if c.AuthJWTSecret != "" {
+		auth = append(auth, "JWT")
+	}
+	if len(auth) == 0 {
+		auth = append(auth, "none")
+	}
+	tls := "off"
+	switch {
+	case c.TLSSelfSigned:
+		tls = "self-signed"
+	case c.TLS:
+		tls = c.TLSCert
+	}
+	return fmt.Sprintf("Port=%d, TLS=%s, Source=%s, Resolution=%dx%d@%dfps, Rotation=%d°, Bitrate=%s, CORS=%s, Auth=%s, Recording=%s",
+		c.Addr, tls, c.Source, c.Width, c.Height, c.Framerate, c.Rotation, bitrate, c.CorsOrigin, strings.Join(auth, "+"), recording)
 }
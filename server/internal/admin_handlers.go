@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"webrtc-ipcam/config"
+)
+
+const redacted = "<redacted>"
+
+// HandleAdminConfig handles GET /admin/config: the effective configuration after
+// defaults and validation, with passwords, tokens and secrets redacted
+func HandleAdminConfig(w http.ResponseWriter, r *http.Request, conf *config.ServerConfig) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	safe := *conf
+	safe.ICEServers = make([]config.ICEServer, len(conf.ICEServers))
+	for i, server := range conf.ICEServers {
+		if server.Credential != "" {
+			server.Credential = redacted
+		}
+		safe.ICEServers[i] = server
+	}
+	safe.AuthTokens = redactCredentials(conf.AuthTokens)
+	safe.AuthUsers = redactCredentials(conf.AuthUsers)
+	if safe.AuthJWTSecret != "" {
+		safe.AuthJWTSecret = redacted
+	}
+	if safe.TURNSecret != "" {
+		safe.TURNSecret = redacted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(safe)
+}
+
+func redactCredentials(credentials []config.AuthCredential) []config.AuthCredential {
+	safe := make([]config.AuthCredential, len(credentials))
+	for i, credential := range credentials {
+		credential.Secret = redacted
+		safe[i] = credential
+	}
+	return safe
+}
@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-ipcam/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authentication for the HTTP and signaling endpoints. Every configured method is accepted:
+//
+//	Authorization: Bearer <token>         a static auth_token, or a JWT signed with auth_jwt_secret
+//	Authorization: Basic <user:password>  an auth_user with a bcrypt password hash
+//	?access_token=<token>                 same as Bearer, for WebSockets and download links, which cannot set headers
+//
+// A share link token (see share.go) is accepted the same way, but only on routes
+// wrapped with RequireOrShare for its scope.
+//
+// Each route also needs a minimum role: viewers may watch, recorders may also
+// record and download, admins may also change or delete things. A token or user
+// gets its role from the config, a JWT from its "role" claim (default viewer).
+
+const (
+	jwtLeeway     = 30 * time.Second // Allowed clock skew for exp and nbf
+	basicCacheTTL = 5 * time.Minute  // How long a verified Basic password skips bcrypt
+)
+
+var errNoCredentials = errors.New("no credentials")
+
+// Role is what a caller may do; each role includes the ones before it
+type Role int
+
+const (
+	RoleViewer   Role = iota + 1 // Live view and status
+	RoleRecorder                 // Start and stop recordings, list and download them
+	RoleAdmin                    // Configuration and deleting recordings
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleRecorder:
+		return "recorder"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// parseRole maps a config or JWT role name to a Role, defaulting to viewer
+func parseRole(name string) (Role, error) {
+	switch name {
+	case "", "viewer":
+		return RoleViewer, nil
+	case "recorder":
+		return RoleRecorder, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Name    string // Token name, user name or JWT subject
+	Method  string // "token", "basic", "jwt" or "share"
+	Role    Role   // None for share links
+	ShareID string // Share link the guest used, so revoking it can disconnect them
+
+	share *ShareLink
+}
+
+func (id Identity) String() string {
+	return fmt.Sprintf("%s (%s)", id.Name, id.Role)
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity the auth middleware attached to the request context
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// shareID returns the share link a request was authenticated with, if any
+func shareID(r *http.Request) string {
+	identity, _ := IdentityFromContext(r.Context())
+	return identity.ShareID
+}
+
+// callerName names the caller of a request for logs and recording metadata,
+// "anonymous" when authentication is disabled
+func callerName(r *http.Request) string {
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		return identity.Name
+	}
+	return "anonymous"
+}
+
+// Authenticator checks request credentials against the configured tokens, users and JWT secret
+type Authenticator struct {
+	tokens    []config.AuthCredential
+	users     map[string]config.AuthCredential
+	dummyHash []byte // Compared against for unknown users, so they take as long as known ones
+	jwtSecret []byte
+	realm     string
+	shares    *ShareLinks
+
+	// bcrypt takes ~100ms per check on a Pi, too slow to repeat for every status poll
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time // sha256(user, password) -> expiry
+}
+
+// NewAuthenticator returns nil when no authentication method is configured.
+// Tokens from shares are accepted on routes wrapped with RequireOrShare.
+func NewAuthenticator(conf *config.ServerConfig, shares *ShareLinks) *Authenticator {
+	if !conf.AuthEnabled() {
+		return nil
+	}
+	a := &Authenticator{
+		tokens:   conf.AuthTokens,
+		users:    make(map[string]config.AuthCredential),
+		realm:    conf.AuthRealm,
+		shares:   shares,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+	for _, user := range conf.AuthUsers {
+		a.users[user.Name] = user
+		if a.dummyHash == nil {
+			a.dummyHash = []byte(user.Secret)
+		}
+	}
+	if conf.AuthJWTSecret != "" {
+		a.jwtSecret = []byte(conf.AuthJWTSecret)
+	}
+	return a
+}
+
+// Require wraps a handler so it only runs for requests authenticated with at least
+// the given role, with the caller's Identity in the request context. A nil
+// Authenticator allows everything.
+func (a *Authenticator) Require(role Role, next http.Handler) http.Handler {
+	return a.RequireOrShare(role, "", next)
+}
+
+// RequireOrShare is Require, but also admits share links with the given scope
+func (a *Authenticator) RequireOrShare(role Role, shareScope string, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS preflight requests never carry credentials; enableCORS answers them
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := a.authenticate(r)
+		if err != nil {
+			log.Printf("Authentication failed for %s %s from %s: %v", r.Method, r.URL.Path, remoteIP(r), err)
+			a.challenge(w)
+			return
+		}
+		if identity.share != nil {
+			if shareScope == "" || !identity.share.allows(shareScope, r) {
+				log.Printf("Forbidden: %s from %s is not valid for %s %s", identity.Name, remoteIP(r), r.Method, r.URL.Path)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		} else if identity.Role < role {
+			log.Printf("Forbidden: %s from %s needs %s for %s %s", identity, remoteIP(r), role, r.Method, r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (Identity, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, credentials, _ := strings.Cut(header, " ")
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			return a.checkBearer(strings.TrimSpace(credentials))
+		case "basic":
+			user, password, ok := r.BasicAuth()
+			if !ok {
+				return Identity{}, errors.New("malformed Basic credentials")
+			}
+			return a.checkBasic(user, password)
+		default:
+			return Identity{}, fmt.Errorf("unsupported scheme %q", scheme)
+		}
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return a.checkBearer(token)
+	}
+	return Identity{}, errNoCredentials
+}
+
+// checkBearer accepts a static token or, if a JWT secret is set, a signed JWT
+func (a *Authenticator) checkBearer(token string) (Identity, error) {
+	if a.shares != nil && strings.HasPrefix(token, sharePrefix) {
+		link, err := a.shares.Verify(token)
+		if err != nil {
+			return Identity{}, err
+		}
+		return Identity{Name: link.name(), Method: "share", ShareID: link.ID, share: link}, nil
+	}
+	if a.jwtSecret != nil && strings.Count(token, ".") == 2 {
+		return a.checkJWT(token)
+	}
+
+	// Compare against every token so the time taken does not reveal which one nearly matched
+	var match *config.AuthCredential
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.tokens[i].Secret)) == 1 {
+			match = &a.tokens[i]
+		}
+	}
+	if match == nil {
+		return Identity{}, errors.New("invalid token")
+	}
+	return credentialIdentity(*match, "token"), nil
+}
+
+func (a *Authenticator) checkBasic(user, password string) (Identity, error) {
+	credential, known := a.users[user]
+	if !known {
+		if a.dummyHash != nil {
+			bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		}
+		return Identity{}, fmt.Errorf("unknown user %q", user)
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	now := time.Now()
+	a.mu.Lock()
+	expiry, cached := a.verified[key]
+	a.mu.Unlock()
+	if cached && now.Before(expiry) {
+		return credentialIdentity(credential, "basic"), nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(credential.Secret), []byte(password)); err != nil {
+		return Identity{}, fmt.Errorf("wrong password for user %q", user)
+	}
+
+	a.mu.Lock()
+	for k, exp := range a.verified {
+		if now.After(exp) {
+			delete(a.verified, k)
+		}
+	}
+	a.verified[key] = now.Add(basicCacheTTL)
+	a.mu.Unlock()
+	return credentialIdentity(credential, "basic"), nil
+}
+
+// credentialIdentity is the identity of a configured token or user; the config
+// only accepts known role names
+func credentialIdentity(credential config.AuthCredential, method string) Identity {
+	role, err := parseRole(credential.Role)
+	if err != nil {
+		role = RoleViewer
+	}
+	return Identity{Name: credential.Name, Method: method, Role: role}
+}
+
+// checkJWT verifies an HMAC-signed JWT (RFC 7519). exp is required so a leaked token stops working.
+func (a *Authenticator) checkJWT(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	var newHash func() hash.Hash
+	switch header.Alg {
+	case "HS256":
+		newHash = sha256.New
+	case "HS384":
+		newHash = sha512.New384
+	case "HS512":
+		newHash = sha512.New
+	default:
+		return Identity{}, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.New("invalid JWT signature encoding")
+	}
+	mac := hmac.New(newHash, a.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return Identity{}, errors.New("invalid JWT signature")
+	}
+
+	var claims struct {
+		Sub  string   `json:"sub"`
+		Role string   `json:"role"`
+		Exp  *float64 `json:"exp"`
+		Nbf  *float64 `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	now := time.Now()
+	if claims.Exp == nil {
+		return Identity{}, errors.New("JWT has no exp claim")
+	}
+	if now.After(unixTime(*claims.Exp).Add(jwtLeeway)) {
+		return Identity{}, errors.New("JWT expired")
+	}
+	if claims.Nbf != nil && now.Before(unixTime(*claims.Nbf).Add(-jwtLeeway)) {
+		return Identity{}, errors.New("JWT not valid yet")
+	}
+
+	role, err := parseRole(claims.Role)
+	if err != nil {
+		return Identity{}, fmt.Errorf("JWT %w", err)
+	}
+	name := claims.Sub
+	if name == "" {
+		name = "jwt"
+	}
+	return Identity{Name: name, Method: "jwt", Role: role}, nil
+}
+
+// challenge replies 401 with a WWW-Authenticate header for each accepted scheme
+func (a *Authenticator) challenge(w http.ResponseWriter) {
+	if len(a.users) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.realm))
+	}
+	if len(a.tokens) > 0 || a.jwtSecret != nil {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unixTime converts a JWT NumericDate, which may have a fractional part
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// remoteIP returns the address of the peer that sent the request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,8 +1,9 @@
 // Package internal provides the core WebRTC logic for the webrtc-ipcam server.
 //
-// This file implements camera process management and H264 NAL unit streaming.
-// It handles launching the camera process (e.g., rpicam-vid), reading H264 NAL units
-// from the camera output with optimizations for maximum local throughput.
+// This file implements camera stream management and H264 NAL unit streaming.
+// It opens the configured VideoSource (e.g., rpicam-vid), reading H264 NAL units
+// from its output with optimizations for maximum local throughput, and groups
+// them into access units (frames) for broadcasting.
 //
 // For local streaming, direct pipes are optimal. The real throughput gains come from:
 //   - Large read buffers to minimize syscalls
@@ -13,36 +14,71 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"os/exec"
 	"sync"
+	"time"
 )
 
-// CameraManager manages the camera streaming process and H264 NAL unit distribution.
+// CameraManager manages the camera video source and H264 frame distribution.
+// The source is supervised: when it exits or its stream ends, it is reopened
+// with exponential backoff while FrameChan (and so every attached client) stays open.
 type CameraManager struct {
-	NALUChan   chan []byte
-	cmd        *exec.Cmd
-	closer     io.Closer
-	wg         sync.WaitGroup
-	BufferSize int
-	mu         sync.Mutex
-	running    bool
+	FrameChan       chan *Frame
+	source          VideoSource
+	wg              sync.WaitGroup
+	BufferSize      int
+	restartDelay    time.Duration
+	maxRestartDelay time.Duration
+	mu              sync.Mutex
+	running         bool
+	stopping        bool          // Set by Stop, for good
+	stop            chan struct{} // Closed by Stop
+
+	// Supervision state, protected by mu
+	streaming      bool
+	streamStart    time.Time
+	restarts       int
+	lastExitReason string
+	lastExitTime   time.Time
+
+	// Stream parameters parsed from the latest SPS/PPS, protected by mu
+	lastSPS     []byte
+	lastPPS     []byte
+	streamInfo  *StreamInfo
+	streamReady chan struct{} // Closed once streamInfo is first known
 }
 
 // CameraConfig holds configuration for the camera manager
 type CameraConfig struct {
-	ChannelBuffer int // NALU channel buffer size (default: 2000)
-	ReadBuffer    int // Read buffer size in bytes (default: 256KB)
+	ChannelBuffer   int           // Frame channel buffer size (default: 300)
+	ReadBuffer      int           // Read buffer size in bytes (default: 256KB)
+	RestartDelay    time.Duration // Initial delay before restarting a failed source (default: 1s)
+	MaxRestartDelay time.Duration // Upper bound for the exponential restart backoff (default: 30s)
 }
 
+// CameraStatus reports the supervision state of the camera source
+type CameraStatus struct {
+	Source         string      `json:"source"`
+	Running        bool        `json:"running"`  // True while the source is open and streaming
+	UptimeMs       int64       `json:"uptimeMs"` // Time since the source was last (re)opened
+	Restarts       int         `json:"restarts"` // Number of automatic restarts since startup
+	LastExitReason string      `json:"lastExitReason,omitempty"`
+	LastExitTime   int64       `json:"lastExitTime,omitempty"`
+	Stream         *StreamInfo `json:"stream,omitempty"` // Parameters parsed from the stream's SPS/PPS
+}
+
+// stableStreamDuration is how long a source must stream before the restart
+// backoff is reset to its initial delay.
+const stableStreamDuration = 30 * time.Second
+
 // NewCameraManager creates and returns a new CameraManager instance with the given config.
 func NewCameraManager(config CameraConfig) *CameraManager {
 	channelBuffer := config.ChannelBuffer
 	if channelBuffer == 0 {
-		channelBuffer = 2000 // Larger buffer to handle bursts
+		channelBuffer = 300 // ~10s at 30fps to handle bursts
 	}
 
 	readBuffer := config.ReadBuffer
@@ -50,53 +86,143 @@ func NewCameraManager(config CameraConfig) *CameraManager {
 		readBuffer = 256 * 1024 // 256KB - sweet spot for video streaming
 	}
 
+	restartDelay := config.RestartDelay
+	if restartDelay == 0 {
+		restartDelay = 1 * time.Second
+	}
+
+	maxRestartDelay := config.MaxRestartDelay
+	if maxRestartDelay == 0 {
+		maxRestartDelay = 30 * time.Second
+	}
+
 	return &CameraManager{
-		NALUChan:   make(chan []byte, channelBuffer),
-		BufferSize: readBuffer,
+		FrameChan:       make(chan *Frame, channelBuffer),
+		BufferSize:      readBuffer,
+		restartDelay:    restartDelay,
+		maxRestartDelay: maxRestartDelay,
+		stop:            make(chan struct{}),
+		streamReady:     make(chan struct{}),
 	}
 }
 
-// StartCamera launches the camera streaming process using the provided shell command.
-// It reads H264 NAL units from stdout and sends them to the NALU channel for broadcasting.
-// Returns an error if camera is already running or fails to start.
-func (cm *CameraManager) StartCamera(cameraCmd string) error {
+// StartCamera opens the given video source and starts streaming from it.
+// It reads H264 NAL units from the source and sends them as frames to the frame channel for broadcasting.
+// Returns an error if camera is already running or has been stopped, or the source fails
+// to open the first time; later failures are retried in the background.
+func (cm *CameraManager) StartCamera(source VideoSource) error {
 	cm.mu.Lock()
 	if cm.running {
 		cm.mu.Unlock()
 		return fmt.Errorf("camera is already running")
 	}
+	if cm.stopping {
+		cm.mu.Unlock()
+		return fmt.Errorf("camera has been stopped")
+	}
 	cm.running = true
+	cm.source = source
 	cm.mu.Unlock()
 
-	cm.cmd = exec.Command("sh", "-c", cameraCmd)
-	cm.cmd.Stderr = os.Stderr
-
-	stdout, err := cm.cmd.StdoutPipe()
+	stream, err := cm.openSource()
 	if err != nil {
-		return fmt.Errorf("stdout pipe error: %w", err)
-	}
-	cm.closer = stdout
-
-	if err := cm.cmd.Start(); err != nil {
 		cm.mu.Lock()
 		cm.running = false
 		cm.mu.Unlock()
-		return fmt.Errorf("failed to start camera: %w", err)
+		return err
 	}
 
-	log.Printf("Camera process started (PID: %d), streaming H264...", cm.cmd.Process.Pid)
-
-	// Start reading in goroutine
+	// Start supervising in goroutine
 	cm.wg.Add(1)
-	go cm.readStream(stdout)
+	go cm.supervise(stream)
 
 	return nil
 }
 
-// readStream reads H264 data from stdout and extracts NAL units with optimized buffering
-func (cm *CameraManager) readStream(reader io.Reader) {
+// openSource opens the source unless Stop has been called. The lock is held
+// across Open so Stop cannot miss a process started concurrently.
+func (cm *CameraManager) openSource() (io.ReadCloser, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.stopping {
+		return nil, fmt.Errorf("camera is stopping")
+	}
+
+	stream, err := cm.source.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cm.source, err)
+	}
+
+	cm.streaming = true
+	cm.streamStart = time.Now()
+	log.Printf("Camera source %s opened", cm.source)
+	return stream, nil
+}
+
+// supervise reads the stream until it ends, then reopens the source with
+// exponential backoff until Stop is called.
+func (cm *CameraManager) supervise(stream io.ReadCloser) {
 	defer cm.wg.Done()
 
+	delay := cm.restartDelay
+	for {
+		started := time.Now()
+		reason := cm.readStream(stream)
+
+		cm.mu.Lock()
+		cm.streaming = false
+		cm.lastExitReason = reason
+		cm.lastExitTime = time.Now()
+		stopping := cm.stopping
+		cm.mu.Unlock()
+
+		if stopping {
+			return
+		}
+
+		// A source that streamed for a while gets a fresh backoff
+		if time.Since(started) >= stableStreamDuration {
+			delay = cm.restartDelay
+		}
+
+		for {
+			log.Printf("Camera source stopped (%s), restarting in %v...", reason, delay)
+			select {
+			case <-time.After(delay):
+			case <-cm.stop:
+				return
+			}
+			delay = min(delay*2, cm.maxRestartDelay)
+
+			var err error
+			stream, err = cm.openSource()
+			if err == nil {
+				break
+			}
+			reason = err.Error()
+
+			cm.mu.Lock()
+			cm.lastExitReason = reason
+			cm.lastExitTime = time.Now()
+			stopping = cm.stopping
+			cm.mu.Unlock()
+			if stopping {
+				return
+			}
+		}
+
+		cm.mu.Lock()
+		cm.restarts++
+		restarts := cm.restarts
+		cm.mu.Unlock()
+		log.Printf("Camera source restarted (restart #%d)", restarts)
+	}
+}
+
+// readStream reads H264 data from the source and extracts NAL units with optimized buffering.
+// It returns a description of why the stream ended.
+func (cm *CameraManager) readStream(reader io.ReadCloser) string {
 	// Use buffered reader for efficient reading
 	bufReader := bufio.NewReaderSize(reader, cm.BufferSize)
 
@@ -104,42 +230,222 @@ func (cm *CameraManager) readStream(reader io.Reader) {
 	naluBuf := make([]byte, 0, cm.BufferSize*2)
 	readBuf := make([]byte, cm.BufferSize)
 
+	// Groups NAL units into frames; a restarted source starts a fresh assembler
+	assembler := &accessUnitAssembler{}
+
+	// Read time of the oldest byte still in naluBuf, i.e. when the NAL unit
+	// at its head started arriving. Frames are stamped with this capture time.
+	var bufStart time.Time
+
 	// Statistics for monitoring
-	var totalNALUs, droppedNALUs uint64
+	var totalFrames, droppedFrames uint64
 
+	reason := "stream ended"
+	eof := false
 	for {
 		n, err := bufReader.Read(readBuf)
 		if n > 0 {
+			now := time.Now()
+			if len(naluBuf) == 0 {
+				bufStart = now
+			}
 			naluBuf = append(naluBuf, readBuf[:n]...)
 
 			// Extract all complete NAL units from buffer
-			cm.extractNALUs(&naluBuf, &totalNALUs, &droppedNALUs)
+			cm.extractNALUs(&naluBuf, &bufStart, now, assembler, &totalFrames, &droppedFrames)
 		}
 
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("Stream read error: %v", err)
+				reason = fmt.Sprintf("read error: %v", err)
 			} else {
-				log.Println("Camera stream ended normally")
+				log.Println("Camera stream ended")
+				eof = true
 			}
 			break
 		}
 	}
 
+	// At EOF the remaining bytes are the final NAL unit, with no start code after it
+	if eof && findNALUStart(naluBuf) == 0 && len(naluBuf) > 4 {
+		if frame := assembler.push(naluBuf, bufStart); frame != nil {
+			cm.sendFrame(frame, &totalFrames, &droppedFrames)
+		}
+	}
+
+	// Emit the last complete frame
+	if frame := assembler.flush(); frame != nil {
+		cm.sendFrame(frame, &totalFrames, &droppedFrames)
+	}
+
 	// Log statistics
-	if droppedNALUs > 0 {
-		dropRate := float64(droppedNALUs) / float64(totalNALUs) * 100
-		log.Printf("Camera stats - Total NALUs: %d, Dropped: %d (%.2f%%)",
-			totalNALUs, droppedNALUs, dropRate)
+	if droppedFrames > 0 {
+		dropRate := float64(droppedFrames) / float64(totalFrames) * 100
+		log.Printf("Camera stats - Total frames: %d, Dropped: %d (%.2f%%)",
+			totalFrames, droppedFrames, dropRate)
 	} else {
-		log.Printf("Camera stats - Total NALUs: %d, No drops", totalNALUs)
+		log.Printf("Camera stats - Total frames: %d, No drops", totalFrames)
+	}
+
+	if err := reader.Close(); err != nil {
+		log.Printf("Camera source exited: %v", err)
+		reason = fmt.Sprintf("source exited: %v", err)
+	}
+	return reason
+}
+
+// GetStatus returns the current supervision state of the camera source
+func (cm *CameraManager) GetStatus() *CameraStatus {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	status := &CameraStatus{
+		Running:        cm.streaming,
+		Restarts:       cm.restarts,
+		LastExitReason: cm.lastExitReason,
+	}
+	if cm.source != nil {
+		status.Source = cm.source.String()
+	}
+	if cm.streaming {
+		status.UptimeMs = time.Since(cm.streamStart).Milliseconds()
+	}
+	if !cm.lastExitTime.IsZero() {
+		status.LastExitTime = cm.lastExitTime.UnixMilli()
 	}
+	status.Stream = cm.streamInfo
+	return status
 }
 
-// extractNALUs efficiently extracts complete NAL units from the buffer
-func (cm *CameraManager) extractNALUs(naluBuf *[]byte, totalNALUs, droppedNALUs *uint64) {
-	buf := *naluBuf
+// RequestKeyframe forwards a keyframe request to the source when it supports on-demand IDR frames.
+// Returns ErrKeyframeUnsupported otherwise.
+func (cm *CameraManager) RequestKeyframe() error {
+	cm.mu.Lock()
+	source := cm.source
+	streaming := cm.streaming
+	cm.mu.Unlock()
+
+	requester, ok := source.(KeyframeRequester)
+	if !ok {
+		return ErrKeyframeUnsupported
+	}
+	if !streaming {
+		return fmt.Errorf("camera source is not streaming")
+	}
+	return requester.RequestKeyframe()
+}
+
+// updateStreamInfo re-parses the stream parameters when a frame carries a changed SPS or PPS
+func (cm *CameraManager) updateStreamInfo(frame *Frame) {
+	var sps, pps []byte
+	for _, nalu := range frame.NALUs {
+		switch naluType(nalu) {
+		case naluTypeSPS:
+			sps = nalu
+		case naluTypePPS:
+			pps = nalu
+		}
+	}
+	if sps == nil && pps == nil {
+		return
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	changed := false
+	if sps != nil && !bytes.Equal(sps, cm.lastSPS) {
+		cm.lastSPS = append([]byte(nil), sps...)
+		changed = true
+	}
+	if pps != nil && !bytes.Equal(pps, cm.lastPPS) {
+		cm.lastPPS = append([]byte(nil), pps...)
+		changed = true
+	}
+	if !changed || cm.lastSPS == nil {
+		return
+	}
+
+	spsInfo, err := ParseSPS(cm.lastSPS)
+	if err != nil {
+		log.Printf("Failed to parse SPS: %v", err)
+		return
+	}
+	var ppsInfo *PPSInfo
+	if cm.lastPPS != nil {
+		if ppsInfo, err = ParsePPS(cm.lastPPS); err != nil {
+			log.Printf("Failed to parse PPS: %v", err)
+		}
+	}
+
+	info := NewStreamInfo(spsInfo, ppsInfo)
+	if cm.streamInfo == nil || *cm.streamInfo != *info {
+		log.Printf("Camera stream: H264 %s level %s (profile-level-id %s), %dx%d @ %.2ffps",
+			info.Profile, info.Level, info.ProfileLevelID, info.Width, info.Height, info.Framerate)
+	}
+	if cm.streamInfo == nil {
+		close(cm.streamReady)
+	}
+	cm.streamInfo = info
+}
 
+// WaitForStreamInfo blocks until the stream parameters are known or the timeout
+// expires, returning nil on timeout.
+func (cm *CameraManager) WaitForStreamInfo(timeout time.Duration) *StreamInfo {
+	select {
+	case <-cm.streamReady:
+	case <-time.After(timeout):
+		return nil
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.streamInfo
+}
+
+// extractNALUs efficiently extracts complete NAL units from the buffer and
+// feeds them to the assembler, sending every completed frame. The first NAL
+// unit started arriving at bufStart, the others within the read at now.
+func (cm *CameraManager) extractNALUs(naluBuf *[]byte, bufStart *time.Time, now time.Time, assembler *accessUnitAssembler, totalFrames, droppedFrames *uint64) {
+	nalus, rest := splitNALUs(*naluBuf)
+
+	for i, nalu := range nalus {
+		capture := now
+		if i == 0 {
+			capture = *bufStart
+		}
+		if frame := assembler.push(nalu, capture); frame != nil {
+			cm.sendFrame(frame, totalFrames, droppedFrames)
+		}
+	}
+	if len(nalus) > 0 {
+		*bufStart = now
+	}
+
+	// Keep remaining bytes for next read
+	*naluBuf = rest
+}
+
+// sendFrame hands a frame to the broadcaster without blocking the camera
+func (cm *CameraManager) sendFrame(frame *Frame, totalFrames, droppedFrames *uint64) {
+	*totalFrames++
+	cm.updateStreamInfo(frame)
+
+	// Non-blocking send - prioritize keeping camera flowing
+	select {
+	case cm.FrameChan <- frame:
+		// Sent successfully
+	default:
+		// Channel full - drop this frame to prevent camera backpressure
+		*droppedFrames++
+	}
+}
+
+// splitNALUs splits all complete NAL units (start code included) off the front of buf.
+// Each returned NALU is a fresh copy; rest holds the trailing bytes that may belong
+// to a NAL unit still being received and must be prepended to the next read.
+func splitNALUs(buf []byte) (nalus [][]byte, rest []byte) {
 	for len(buf) > 4 {
 		// Find first NAL unit start
 		start := findNALUStart(buf)
@@ -147,9 +453,9 @@ func (cm *CameraManager) extractNALUs(naluBuf *[]byte, totalNALUs, droppedNALUs
 			// No start code found, keep last 3 bytes in case split across reads
 			if len(buf) > 3 {
 				copy(buf[:3], buf[len(buf)-3:])
-				*naluBuf = buf[:3]
+				buf = buf[:3]
 			}
-			return
+			return nalus, buf
 		}
 
 		// Discard data before start code
@@ -161,32 +467,20 @@ func (cm *CameraManager) extractNALUs(naluBuf *[]byte, totalNALUs, droppedNALUs
 		nextStart := findNALUStart(buf[4:])
 		if nextStart == -1 {
 			// Incomplete NAL unit, keep for next iteration
-			*naluBuf = buf
-			return
+			return nalus, buf
 		}
 
 		// Extract complete NAL unit
 		naluLen := 4 + nextStart
 		nalu := make([]byte, naluLen)
 		copy(nalu, buf[:naluLen])
-
-		*totalNALUs++
-
-		// Non-blocking send - prioritize keeping camera flowing
-		select {
-		case cm.NALUChan <- nalu:
-			// Sent successfully
-		default:
-			// Channel full - drop this frame to prevent camera backpressure
-			*droppedNALUs++
-		}
+		nalus = append(nalus, nalu)
 
 		// Move to next NAL unit
 		buf = buf[naluLen:]
 	}
 
-	// Keep remaining bytes for next read
-	*naluBuf = buf
+	return nalus, buf
 }
 
 // findNALUStart performs optimized search for H264 NAL unit start code
@@ -223,40 +517,36 @@ func findNALUStart(buf []byte) int {
 	return -1
 }
 
-// GetNALUChannel returns the channel for receiving H264 NAL units.
-func (cm *CameraManager) GetNALUChannel() <-chan []byte {
-	return cm.NALUChan
+// GetFrameChannel returns the channel for receiving H264 frames.
+func (cm *CameraManager) GetFrameChannel() <-chan *Frame {
+	return cm.FrameChan
 }
 
-// Stop gracefully stops the camera process and waits for cleanup
+// Stop gracefully stops the camera source and waits for cleanup. It is final:
+// FrameChan is closed, which ends the broadcast reading it, so the manager
+// cannot be started again.
 func (cm *CameraManager) Stop() error {
 	cm.mu.Lock()
-	if !cm.running {
+	if !cm.running || cm.stopping {
 		cm.mu.Unlock()
 		return nil
 	}
+	cm.stopping = true
+	source := cm.source
 	cm.mu.Unlock()
 
-	if cm.cmd == nil || cm.cmd.Process == nil {
-		return nil
-	}
-
-	pid := cm.cmd.Process.Pid
-	log.Printf("Stopping camera process (PID: %d)...", pid)
+	// Interrupt any pending restart backoff
+	close(cm.stop)
 
-	// Try graceful shutdown first
-	if err := cm.cmd.Process.Signal(os.Interrupt); err != nil {
-		log.Printf("Graceful shutdown failed, force killing process: %v", err)
-		if killErr := cm.cmd.Process.Kill(); killErr != nil {
-			log.Printf("Failed to kill process: %v", killErr)
-		}
+	if err := source.Close(); err != nil {
+		log.Printf("Failed to close camera source: %v", err)
 	}
 
-	// Wait for read goroutine to finish
+	// Wait for supervisor goroutine to finish
 	cm.wg.Wait()
 
 	// Close channel
-	close(cm.NALUChan)
+	close(cm.FrameChan)
 
 	cm.mu.Lock()
 	cm.running = false
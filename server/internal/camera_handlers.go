@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"webrtc-ipcam/config"
+)
+
+// HandleCameraStatus handles GET /camera/status
+func HandleCameraStatus(w http.ResponseWriter, r *http.Request, camera *CameraManager) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(camera.GetStatus())
+}
+
+// HandleCameras handles GET /cameras: this camera, at the server the client was
+// loaded from, followed by the other cameras configured with camera lines
+func HandleCameras(w http.ResponseWriter, r *http.Request, conf *config.ServerConfig) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cameras := append([]config.Camera{{Endpoint: "", Title: conf.CameraTitle}}, conf.Cameras...)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(cameras)
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Per-viewer congestion control.
+//
+// A viewer is congested when its send queue backs up or when the stream
+// bitrate exceeds a loss-based bandwidth estimate fed by its receiver reports.
+// Dropping arbitrary frames would corrupt decoding until the next IDR, so a
+// congested viewer drops whole GOPs: it only receives keyframes (with SPS/PPS)
+// until it recovers, and resumes full framerate at a keyframe. The viewer sees
+// a lower framerate instead of smeared video.
+
+const (
+	congestionHighWater = 15 // Queued frames (~0.5s at 30fps) that mark a viewer as congested
+	congestionLowWater  = 3  // Queued frames below which a congested viewer may resume
+
+	// Loss thresholds from the loss-based controller in draft-ietf-rmcat-gcc
+	lossHigh = 0.10 // Above this the estimate backs off
+	lossLow  = 0.02 // Below this the estimate grows
+
+	estimateGrowth   = 1.08    // Per receiver report with low loss
+	minEstimateBps   = 100_000 // Floor for the bandwidth estimate
+	rateWindow       = time.Second
+	rateSmoothing    = 0.3 // Weight of the newest window in the stream bitrate average
+	estimateHeadroom = 2   // Cap the estimate at this multiple of the stream bitrate
+)
+
+// frameDecision tells the broadcaster what to queue for a viewer
+type frameDecision int
+
+const (
+	deliverFrame    frameDecision = iota // Queue the frame as is
+	deliverKeyframe                      // Queue the cached SPS/PPS/IDR in place of this keyframe
+	dropFrame                            // Skip the frame
+)
+
+// congestionController tracks one viewer's congestion state. admit is called by
+// the broadcaster, onReceiverReport from the RTCP reader.
+type congestionController struct {
+	mu sync.Mutex
+
+	dropping     bool // Sending keyframes only until the viewer recovers
+	droppedGOPs  uint64
+	congestedFor string // Why the viewer was last marked congested, for logging
+
+	// Stream bitrate, measured from the frames offered to this viewer
+	streamBps   float64
+	windowStart time.Time
+	windowBytes int
+
+	// Loss-based estimate of what the viewer's path can carry, 0 until the first receiver report
+	estimateBps float64
+}
+
+// admit decides whether a frame from the camera is queued for the viewer, given the current queue length
+func (cc *congestionController) admit(frame *Frame, queued int) frameDecision {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.measureStream(frame)
+
+	overBudget := cc.estimateBps > 0 && cc.streamBps > cc.estimateBps
+
+	if !cc.dropping {
+		switch {
+		case queued >= congestionHighWater:
+			cc.startDropping(fmt.Sprintf("%d frames queued", queued))
+		case overBudget:
+			cc.startDropping(fmt.Sprintf("stream %.0fkbps over estimate %.0fkbps", cc.streamBps/1000, cc.estimateBps/1000))
+		default:
+			return deliverFrame
+		}
+	}
+
+	// While congested only whole keyframes get through, so every frame the viewer decodes is intact
+	if !frame.Keyframe {
+		return dropFrame
+	}
+	if queued <= congestionLowWater && !overBudget {
+		cc.dropping = false
+		log.Printf("Viewer recovered from congestion (%s) after %d dropped GOPs, resuming at keyframe", cc.congestedFor, cc.droppedGOPs)
+		return deliverKeyframe
+	}
+	cc.droppedGOPs++
+	if queued < congestionHighWater {
+		return deliverKeyframe
+	}
+	return dropFrame
+}
+
+// markCongested is called when the viewer's queue overflowed; the rest of the GOP is dropped
+func (cc *congestionController) markCongested() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.dropping {
+		cc.startDropping("send queue full")
+	}
+}
+
+// startDropping switches to keyframe-only delivery. Caller must hold mu.
+func (cc *congestionController) startDropping(reason string) {
+	cc.dropping = true
+	cc.droppedGOPs = 0
+	cc.congestedFor = reason
+	log.Printf("Viewer congested (%s), sending keyframes only", reason)
+}
+
+// measureStream keeps a smoothed bitrate of the camera stream. Caller must hold mu.
+func (cc *congestionController) measureStream(frame *Frame) {
+	if cc.windowStart.IsZero() {
+		cc.windowStart = frame.Timestamp
+	}
+	cc.windowBytes += len(frame.Data)
+
+	elapsed := frame.Timestamp.Sub(cc.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	bps := float64(cc.windowBytes*8) / elapsed.Seconds()
+	if cc.streamBps == 0 {
+		cc.streamBps = bps
+	} else {
+		cc.streamBps = (1-rateSmoothing)*cc.streamBps + rateSmoothing*bps
+	}
+	cc.windowStart = frame.Timestamp
+	cc.windowBytes = 0
+}
+
+// onReceiverReport updates the bandwidth estimate from the loss fraction (out of 256) in a receiver report
+func (cc *congestionController) onReceiverReport(fractionLost uint8) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.streamBps == 0 {
+		return // Nothing to compare against yet
+	}
+	if cc.estimateBps == 0 {
+		cc.estimateBps = cc.streamBps // Start from what the viewer is being sent
+	}
+
+	loss := float64(fractionLost) / 256
+	switch {
+	case loss > lossHigh:
+		cc.estimateBps *= 1 - loss/2
+	case loss < lossLow:
+		cc.estimateBps *= estimateGrowth
+	}
+
+	if cc.estimateBps < minEstimateBps {
+		cc.estimateBps = minEstimateBps
+	}
+	if ceiling := cc.streamBps * estimateHeadroom; cc.estimateBps > ceiling {
+		cc.estimateBps = ceiling
+	}
+}
+
+// state returns whether the viewer is congested and the current bandwidth estimate
+func (cc *congestionController) state() (congested bool, estimateBps float64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.dropping, cc.estimateBps
+}
@@ -0,0 +1,136 @@
+package internal
+
+import "time"
+
+// H264 NAL unit types (ITU-T H.264 Table 7-1)
+const (
+	naluTypeSlice = 1
+	naluTypeIDR   = 5
+	naluTypeSEI   = 6
+	naluTypeSPS   = 7
+	naluTypePPS   = 8
+	naluTypeAUD   = 9
+	naluTypeEOSeq = 10
+	naluTypeEOStr = 11
+)
+
+// Frame is one H264 access unit: every NAL unit of a single picture, including
+// any AUD/SPS/PPS/SEI sent ahead of it. All of them share one capture timestamp.
+type Frame struct {
+	Data      []byte    // Annex-B bytes of the whole access unit, start codes included
+	NALUs     [][]byte  // Individual NAL units, sub-slices of Data
+	Keyframe  bool      // Contains an IDR slice
+	Timestamp time.Time // Capture time: when the frame started arriving from the camera (carries a monotonic reading)
+}
+
+// naluPayload strips the 3 or 4 byte Annex-B start code, returning the NAL header and payload.
+func naluPayload(nalu []byte) []byte {
+	if len(nalu) >= 4 && nalu[0] == 0 && nalu[1] == 0 && nalu[2] == 0 && nalu[3] == 1 {
+		return nalu[4:]
+	}
+	if len(nalu) >= 3 && nalu[0] == 0 && nalu[1] == 0 && nalu[2] == 1 {
+		return nalu[3:]
+	}
+	return nalu
+}
+
+// naluType returns the nal_unit_type of an Annex-B NAL unit, or 0 if it is empty.
+func naluType(nalu []byte) byte {
+	payload := naluPayload(nalu)
+	if len(payload) == 0 {
+		return 0
+	}
+	return payload[0] & 0x1F
+}
+
+// isVCL reports whether the NAL unit type carries coded slice data.
+func isVCL(t byte) bool {
+	return t >= naluTypeSlice && t <= naluTypeIDR
+}
+
+// isFrameStart reports whether nalu is the first slice of a picture
+// (a VCL NAL unit whose first_mb_in_slice is 0).
+func isFrameStart(nalu []byte) bool {
+	payload := naluPayload(nalu)
+	if len(payload) < 2 || !isVCL(payload[0]&0x1F) {
+		return false
+	}
+	// first_mb_in_slice is ue(v); a leading 1 bit encodes the value 0
+	return payload[1]&0x80 != 0
+}
+
+// startsAccessUnit reports whether nalu begins a new access unit, given whether
+// the current one has a slice yet (H.264 section 7.4.1.2.3)
+func startsAccessUnit(nalu []byte, hasVCL bool) bool {
+	if !hasVCL {
+		return false
+	}
+	t := naluType(nalu)
+	switch {
+	case t == naluTypeAUD || t == naluTypeSPS || t == naluTypePPS || t == naluTypeSEI || (t >= 14 && t <= 18):
+		return true
+	case isVCL(t):
+		return isFrameStart(nalu)
+	}
+	return false
+}
+
+// accessUnitAssembler groups a stream of NAL units into access units following
+// the boundary rules of H.264 section 7.4.1.2.3: a new access unit begins at an
+// AUD, SPS, PPS, SEI or reserved 14-18 NAL unit that follows a VCL NAL unit, or
+// at the first slice (first_mb_in_slice == 0) of a new picture.
+type accessUnitAssembler struct {
+	frame  *Frame
+	hasVCL bool
+}
+
+// push adds a NAL unit read at the given time. It returns the previous access
+// unit when nalu starts a new one, and nil otherwise.
+func (a *accessUnitAssembler) push(nalu []byte, now time.Time) *Frame {
+	var done *Frame
+
+	t := naluType(nalu)
+	if startsAccessUnit(nalu, a.hasVCL) {
+		done = a.flush()
+	}
+
+	if a.frame == nil {
+		a.frame = &Frame{Timestamp: now}
+	}
+	a.frame.NALUs = append(a.frame.NALUs, nalu)
+	if isVCL(t) {
+		a.hasVCL = true
+	}
+	if t == naluTypeIDR {
+		a.frame.Keyframe = true
+	}
+
+	// End of sequence/stream terminates the access unit it belongs to
+	if (t == naluTypeEOSeq || t == naluTypeEOStr) && done == nil {
+		done = a.flush()
+	}
+	return done
+}
+
+// flush returns the access unit being assembled, or nil if it has no slices.
+func (a *accessUnitAssembler) flush() *Frame {
+	frame := a.frame
+	hasVCL := a.hasVCL
+	a.frame = nil
+	a.hasVCL = false
+	if frame == nil || !hasVCL {
+		return nil
+	}
+
+	size := 0
+	for _, nalu := range frame.NALUs {
+		size += len(nalu)
+	}
+	frame.Data = make([]byte, 0, size)
+	for i, nalu := range frame.NALUs {
+		start := len(frame.Data)
+		frame.Data = append(frame.Data, nalu...)
+		frame.NALUs[i] = frame.Data[start:len(frame.Data):len(frame.Data)]
+	}
+	return frame
+}
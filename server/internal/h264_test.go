@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNALU builds an Annex-B NAL unit from a short name: AUD, SPS, PPS, SEI,
+// EOS, IDR or P, where a trailing + makes a slice continue the picture
+// (first_mb_in_slice > 0). id is appended so every NAL unit is distinct.
+func testNALU(t *testing.T, name string, id byte) []byte {
+	t.Helper()
+	first := byte(0x80) // first_mb_in_slice = 0
+	if strings.HasSuffix(name, "+") {
+		name = strings.TrimSuffix(name, "+")
+		first = 0x40 // first_mb_in_slice = 1
+	}
+	var header []byte
+	switch name {
+	case "AUD":
+		header = []byte{0x09, 0xf0}
+	case "SPS":
+		header = []byte{0x67, 0x42}
+	case "PPS":
+		header = []byte{0x68, 0xce}
+	case "SEI":
+		header = []byte{0x06, 0x05}
+	case "EOS":
+		header = []byte{0x0a}
+	case "IDR":
+		header = []byte{0x65, first}
+	case "P":
+		header = []byte{0x41, first}
+	default:
+		t.Fatalf("unknown NAL unit %q", name)
+	}
+	nalu := append([]byte{0, 0, 0, 1}, header...)
+	return append(nalu, id)
+}
+
+func TestAccessUnitAssembler(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		units []string // NAL units of each access unit returned, in order
+	}{
+		{
+			name:  "parameter sets before IDR",
+			in:    "SPS PPS IDR P P",
+			units: []string{"SPS PPS IDR", "P", "P"},
+		},
+		{
+			name:  "multiple slices",
+			in:    "IDR IDR+ IDR+ P P+ P",
+			units: []string{"IDR IDR+ IDR+", "P P+", "P"},
+		},
+		{
+			name:  "access unit delimiters",
+			in:    "AUD SPS PPS SEI IDR AUD P AUD SEI P",
+			units: []string{"AUD SPS PPS SEI IDR", "AUD P", "AUD SEI P"},
+		},
+		{
+			name:  "SEI starts the next access unit",
+			in:    "P SEI P P+",
+			units: []string{"P", "SEI P P+"},
+		},
+		{
+			name:  "end of sequence",
+			in:    "IDR P EOS SPS PPS IDR",
+			units: []string{"IDR", "P EOS", "SPS PPS IDR"},
+		},
+		{
+			name:  "trailing parameter sets",
+			in:    "IDR SPS PPS",
+			units: []string{"IDR"},
+		},
+		{
+			name:  "leading continuation slice",
+			in:    "P+ P+ P",
+			units: []string{"P+ P+", "P"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := time.Now()
+			var (
+				a      accessUnitAssembler
+				frames []*Frame
+				pushed = map[string]time.Time{} // Push time of each NAL unit
+			)
+			for i, name := range strings.Fields(tt.in) {
+				nalu := testNALU(t, name, byte(i))
+				now := base.Add(time.Duration(i) * time.Millisecond)
+				pushed[string(nalu)] = now
+				if frame := a.push(nalu, now); frame != nil {
+					frames = append(frames, frame)
+				}
+			}
+			if frame := a.flush(); frame != nil {
+				frames = append(frames, frame)
+			}
+			if frame := a.flush(); frame != nil {
+				t.Errorf("second flush returned %d NAL units", len(frame.NALUs))
+			}
+
+			if len(frames) != len(tt.units) {
+				t.Fatalf("%d access units, want %d", len(frames), len(tt.units))
+			}
+			for i, frame := range frames {
+				var names []string
+				var data []byte
+				for _, nalu := range frame.NALUs {
+					names = append(names, nameOfTestNALU(nalu))
+					data = append(data, nalu...)
+				}
+				if got := strings.Join(names, " "); got != tt.units[i] {
+					t.Errorf("access unit %d is %q, want %q", i, got, tt.units[i])
+				}
+				if !bytes.Equal(frame.Data, data) {
+					t.Errorf("access unit %d data % x, want % x", i, frame.Data, data)
+				}
+				if want := strings.Contains(tt.units[i], "IDR"); frame.Keyframe != want {
+					t.Errorf("access unit %d keyframe %v, want %v", i, frame.Keyframe, want)
+				}
+				if want := pushed[string(frame.NALUs[0])]; !frame.Timestamp.Equal(want) {
+					t.Errorf("access unit %d at %v, want its first NAL unit's %v", i, frame.Timestamp.Sub(base), want.Sub(base))
+				}
+			}
+		})
+	}
+}
+
+// nameOfTestNALU reverses testNALU, without the id
+func nameOfTestNALU(nalu []byte) string {
+	name := map[byte]string{
+		naluTypeAUD: "AUD", naluTypeSPS: "SPS", naluTypePPS: "PPS", naluTypeSEI: "SEI",
+		naluTypeEOSeq: "EOS", naluTypeIDR: "IDR", naluTypeSlice: "P",
+	}[naluType(nalu)]
+	if isVCL(naluType(nalu)) && !isFrameStart(nalu) {
+		name += "+"
+	}
+	return name
+}
+
+func TestStartsAccessUnit(t *testing.T) {
+	tests := []struct {
+		nalu   []byte
+		hasVCL bool
+		want   bool
+	}{
+		{[]byte{0, 0, 0, 1, 0x09, 0xf0}, true, true},        // AUD
+		{[]byte{0, 0, 1, 0x67, 0x42}, true, true},           // SPS, 3-byte start code
+		{[]byte{0, 0, 0, 1, 0x68, 0xce}, true, true},        // PPS
+		{[]byte{0, 0, 0, 1, 0x06, 0x05}, true, true},        // SEI
+		{[]byte{0, 0, 0, 1, 0x0e, 0x00}, true, true},        // Prefix NAL unit (14)
+		{[]byte{0, 0, 0, 1, 0x12, 0x00}, true, true},        // Reserved (18)
+		{[]byte{0, 0, 0, 1, 0x13, 0x00}, true, false},       // Auxiliary slice (19)
+		{[]byte{0, 0, 0, 1, 0x0a}, true, false},             // End of sequence
+		{[]byte{0, 0, 0, 1, 0x65, 0x88}, true, true},        // IDR, first_mb_in_slice = 0
+		{[]byte{0, 0, 0, 1, 0x41, 0x9a}, true, true},        // P, first_mb_in_slice = 0
+		{[]byte{0, 0, 0, 1, 0x41, 0x40}, true, false},       // P, first_mb_in_slice = 1
+		{[]byte{0, 0, 0, 1, 0x41, 0x00, 0x88}, true, false}, // P, first_mb_in_slice >= 7
+		{[]byte{0, 0, 0, 1, 0x41}, true, false},             // Truncated slice
+		{[]byte{0, 0, 0, 1, 0x09, 0xf0}, false, false},      // No slice yet
+		{[]byte{0, 0, 0, 1, 0x65, 0x88}, false, false},      // No slice yet
+		{[]byte{0, 0, 0, 1}, true, false},                   // Empty
+		{[]byte{0x41, 0x9a}, true, true},                    // No start code
+	}
+	for _, tt := range tests {
+		if got := startsAccessUnit(tt.nalu, tt.hasVCL); got != tt.want {
+			t.Errorf("startsAccessUnit(% x, %v) = %v, want %v", tt.nalu, tt.hasVCL, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-ipcam/config"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// NewSettingEngine applies the ICE networking options from the config: NAT 1:1 IPs,
+// UDP port range, interface filter, and the single-port UDP and ICE-TCP muxes.
+// The muxes listen for the lifetime of the process and are shared by every viewer.
+func NewSettingEngine(conf *config.ServerConfig) (*webrtc.SettingEngine, error) {
+	s := &webrtc.SettingEngine{}
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	var interfaceFilter func(string) bool
+	if len(conf.ICEInterfaces) > 0 {
+		interfaceFilter = func(name string) bool {
+			return slices.Contains(conf.ICEInterfaces, name)
+		}
+		s.SetInterfaceFilter(interfaceFilter)
+	}
+
+	if len(conf.ICENAT1To1IPs) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if conf.ICENAT1To1Type == "srflx" {
+			candidateType = webrtc.ICECandidateTypeSrflx
+		}
+		s.SetNAT1To1IPs(conf.ICENAT1To1IPs, candidateType)
+	}
+
+	if conf.ICEUDPMuxPort > 0 {
+		var opts []ice.UDPMuxFromPortOption
+		if interfaceFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(interfaceFilter))
+		}
+		udpMux, err := ice.NewMultiUDPMuxFromPort(conf.ICEUDPMuxPort, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("ICE UDP mux on port %d: %w", conf.ICEUDPMuxPort, err)
+		}
+		s.SetICEUDPMux(udpMux)
+	} else if conf.ICEUDPPortMin > 0 {
+		if err := s.SetEphemeralUDPPortRange(uint16(conf.ICEUDPPortMin), uint16(conf.ICEUDPPortMax)); err != nil {
+			return nil, fmt.Errorf("ICE UDP port range: %w", err)
+		}
+	}
+
+	if conf.ICETCPPort > 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: conf.ICETCPPort})
+		if err != nil {
+			return nil, fmt.Errorf("ICE-TCP listener on port %d: %w", conf.ICETCPPort, err)
+		}
+		s.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	s.SetNetworkTypes(networkTypes)
+
+	log.Printf("ICE: %s", describeICE(conf))
+	return s, nil
+}
+
+// peerConfiguration returns the configuration for viewer peer connections
+func peerConfiguration(conf *config.ServerConfig) webrtc.Configuration {
+	var servers []webrtc.ICEServer
+	for _, server := range conf.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return webrtc.Configuration{ICEServers: servers}
+}
+
+// iceStatusMaxAge is how long gathered candidates are reported before gathering again
+const iceStatusMaxAge = time.Minute
+
+// ICEStatus reports the ports viewers connect to and the candidates the server
+// advertises in its answers, found by gathering on a throwaway peer connection
+// that shares the viewers' setting engine (and so their muxes)
+type ICEStatus struct {
+	api  *webrtc.API
+	conf *config.ServerConfig
+
+	mu         sync.Mutex
+	candidates []advertisedCandidate
+	gatheredAt time.Time
+}
+
+// advertisedCandidate is a local ICE candidate as viewers see it
+type advertisedCandidate struct {
+	Type     string `json:"type"`     // host, srflx or relay
+	Protocol string `json:"protocol"` // udp or tcp
+	Address  string `json:"address"`
+	Port     uint16 `json:"port"`
+}
+
+func (c advertisedCandidate) String() string {
+	return fmt.Sprintf("%s %s %s", c.Protocol, c.Type, net.JoinHostPort(c.Address, fmt.Sprint(c.Port)))
+}
+
+func NewICEStatus(api *webrtc.API, conf *config.ServerConfig) *ICEStatus {
+	return &ICEStatus{api: api, conf: conf}
+}
+
+// LogCandidates gathers once and logs what viewers will be offered
+func (s *ICEStatus) LogCandidates() {
+	candidates, _ := s.Candidates()
+	if len(candidates) == 0 {
+		log.Println("WARNING: ICE gathered no candidates, viewers will not be able to connect")
+		return
+	}
+	descriptions := make([]string, len(candidates))
+	for i, c := range candidates {
+		descriptions[i] = c.String()
+	}
+	log.Printf("ICE candidates advertised to viewers: %s", strings.Join(descriptions, ", "))
+}
+
+// Candidates returns the advertised candidates, gathering again when the last result is stale
+func (s *ICEStatus) Candidates() ([]advertisedCandidate, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.gatheredAt) < iceStatusMaxAge {
+		return s.candidates, s.gatheredAt
+	}
+	candidates, err := gatherCandidates(s.api, s.conf)
+	if err != nil {
+		log.Printf("Failed to gather ICE candidates: %v", err)
+		return s.candidates, s.gatheredAt
+	}
+	s.candidates = candidates
+	s.gatheredAt = time.Now()
+	return s.candidates, s.gatheredAt
+}
+
+// gatherCandidates collects the local candidates of a peer connection set up like a viewer's
+func gatherCandidates(api *webrtc.API, conf *config.ServerConfig) ([]advertisedCandidate, error) {
+	peerConn, err := api.NewPeerConnection(peerConfiguration(conf))
+	if err != nil {
+		return nil, err
+	}
+	defer peerConn.Close()
+
+	if _, err := peerConn.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var candidates []advertisedCandidate
+	peerConn.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		mu.Lock()
+		candidates = append(candidates, advertisedCandidate{
+			Type:     c.Typ.String(),
+			Protocol: c.Protocol.String(),
+			Address:  c.Address,
+			Port:     c.Port,
+		})
+		mu.Unlock()
+	})
+
+	offer, err := peerConn.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := peerConn.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	waitForGathering(peerConn, 5*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return candidates, nil
+}
+
+// HandleICEStatus reports the ICE ports and the candidates advertised to viewers
+func HandleICEStatus(w http.ResponseWriter, r *http.Request, status *ICEStatus) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	candidates, gatheredAt := status.Candidates()
+	if candidates == nil {
+		candidates = []advertisedCandidate{}
+	}
+	conf := status.conf
+	response := struct {
+		UDPMuxPort   int                   `json:"udpMuxPort,omitempty"`
+		UDPPortRange string                `json:"udpPortRange,omitempty"`
+		TCPPort      int                   `json:"tcpPort,omitempty"`
+		NAT1To1IPs   []string              `json:"nat1to1IPs,omitempty"`
+		Candidates   []advertisedCandidate `json:"candidates"`
+		GatheredAt   time.Time             `json:"gatheredAt"`
+	}{
+		UDPMuxPort: conf.ICEUDPMuxPort,
+		TCPPort:    conf.ICETCPPort,
+		NAT1To1IPs: conf.ICENAT1To1IPs,
+		Candidates: candidates,
+		GatheredAt: gatheredAt,
+	}
+	if conf.ICEUDPMuxPort == 0 && conf.ICEUDPPortMin > 0 {
+		response.UDPPortRange = fmt.Sprintf("%d-%d", conf.ICEUDPPortMin, conf.ICEUDPPortMax)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// describeICE summarises the ICE options for the startup log, without credentials
+func describeICE(conf *config.ServerConfig) string {
+	var parts []string
+	for _, server := range conf.ICEServers {
+		parts = append(parts, strings.Join(server.URLs, ","))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "no STUN/TURN servers")
+	}
+	if len(conf.ICENAT1To1IPs) > 0 {
+		parts = append(parts, fmt.Sprintf("NAT 1:1 %s (%s)", strings.Join(conf.ICENAT1To1IPs, ","), conf.ICENAT1To1Type))
+	}
+	switch {
+	case conf.ICEUDPMuxPort > 0:
+		parts = append(parts, fmt.Sprintf("UDP mux port %d", conf.ICEUDPMuxPort))
+	case conf.ICEUDPPortMin > 0:
+		parts = append(parts, fmt.Sprintf("UDP ports %d-%d", conf.ICEUDPPortMin, conf.ICEUDPPortMax))
+	}
+	if conf.ICETCPPort > 0 {
+		parts = append(parts, fmt.Sprintf("ICE-TCP port %d", conf.ICETCPPort))
+	}
+	if len(conf.ICEInterfaces) > 0 {
+		parts = append(parts, "interfaces "+strings.Join(conf.ICEInterfaces, ","))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -9,6 +9,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
@@ -21,138 +22,214 @@ type Client struct {
 	dcMu          sync.RWMutex // Protects DataChannel access
 	Packetizer    rtp.Packetizer
 	lastTimestamp uint32
-	tsInc         uint32 // timestamp increment per frame (90kHz / fps)
-	startTime     time.Time
-	naluChan      chan []byte
+	tsBase        uint32    // Random RTP timestamp corresponding to startTime
+	startTime     time.Time // Origin of the capture clock to RTP clock mapping
+	sentAny       bool
+	frameChan     chan *Frame
 	done          chan struct{}
 	wg            sync.WaitGroup // Tracks sender goroutine
+	connected     chan struct{}  // Closed once the peer connection first connects
+	connectOnce   sync.Once
 	sentFrames    uint64
 	droppedFrames uint64
+	lastCaptureMs int64 // Wall-clock capture time of the last sent frame
+	latencyUs     int64 // Capture-to-send delay of the last sent frame
+
+	keyframeRequest    chan struct{} // Signalled by readRTCP on PLI/FIR
+	lastKeyframeResend time.Time     // Owned by the sender goroutine
+	lastCapture        time.Time     // Capture time of the last frame written; owned by the sender goroutine
+	pliCount           uint64
+	firCount           uint64
+	nackCount          uint64
+
+	// Last receiver report from the viewer
+	rttUs        int64  // Round-trip time from LSR/DLSR, 0 until the viewer echoes a sender report
+	fractionLost uint32 // Fraction of packets lost since the previous report, out of 256
+	packetsLost  uint32 // Cumulative packets lost
+	jitter       uint32 // Interarrival jitter in RTP timestamp units
+
+	congestion congestionController
+
+	shareID string // Share link the viewer connected with, empty for accounts
 }
 
 type ClientManager struct {
 	Clients      map[*Client]struct{}
 	Mu           sync.RWMutex
-	lastKeyframe []byte
+	lastKeyframe *Frame
 	lastSPS      []byte
 	lastPPS      []byte
 	recorder     *RecorderManager
+
+	keyframeRequester  KeyframeRequester // Source to forward viewer keyframe requests to
+	lastSourceKeyframe time.Time         // When a keyframe was last requested from the source
 }
 
 type FrameStats struct {
-	SentFrames    uint64 `json:"sentFrames"`
-	DroppedFrames uint64 `json:"droppedFrames"`
-	Timestamp     int64  `json:"timestamp"`
+	SentFrames    uint64  `json:"sentFrames"`
+	DroppedFrames uint64  `json:"droppedFrames"`
+	Timestamp     int64   `json:"timestamp"`             // Server wall clock when stats were sent (ms)
+	CaptureTime   int64   `json:"captureTime,omitempty"` // Wall-clock capture time of the last sent frame (ms)
+	LatencyMs     float64 `json:"latencyMs"`             // Capture-to-send delay of the last sent frame
+	PLICount      uint64  `json:"pliCount"`              // Picture Loss Indications received from the viewer
+	FIRCount      uint64  `json:"firCount"`              // Full Intra Requests received from the viewer
+	NACKCount     uint64  `json:"nackCount"`             // Generic NACKs received from the viewer
+	FractionLost  float64 `json:"fractionLost"`          // Loss reported in the last receiver report (0-1)
+	PacketsLost   uint32  `json:"packetsLost"`           // Cumulative loss reported by the viewer
+	JitterMs      float64 `json:"jitterMs"`              // Interarrival jitter reported by the viewer
+	RTTMs         float64 `json:"rttMs"`                 // Round-trip time derived from the last receiver report
+	Congested     bool    `json:"congested"`             // Viewer is receiving keyframes only
+	EstimateKbps  float64 `json:"estimateKbps"`          // Loss-based bandwidth estimate, 0 until the first receiver report
 }
 
 const maxPayloadSize = 1200 // MTU for packetizer
 
+// Viewers repeat PLIs until they decode a keyframe, so resends and source
+// requests are rate limited to avoid flooding the link with IDR frames.
+const (
+	keyframeResendInterval = 500 * time.Millisecond
+	sourceKeyframeInterval = 1 * time.Second
+)
+
 func NewClientManager() *ClientManager {
 	return &ClientManager{
 		Clients: make(map[*Client]struct{}),
 	}
 }
 
-// SetRecorder attaches a recorder to receive NALUs
+// DisconnectShare closes the connections of viewers who joined with a share link,
+// once it is revoked or expires. Returns how many were disconnected.
+func (cm *ClientManager) DisconnectShare(id string) int {
+	cm.Mu.RLock()
+	var clients []*Client
+	for c := range cm.Clients {
+		if c.shareID == id {
+			clients = append(clients, c)
+		}
+	}
+	cm.Mu.RUnlock()
+
+	// Closing triggers the connection state handler, which removes the client
+	for _, c := range clients {
+		c.PeerConn.Close()
+	}
+	return len(clients)
+}
+
+// SetRecorder attaches a recorder to receive frames
 func (cm *ClientManager) SetRecorder(rec *RecorderManager) {
 	cm.Mu.Lock()
 	cm.recorder = rec
 	cm.Mu.Unlock()
 }
 
-func (cm *ClientManager) BroadcastNALUs(naluChan <-chan []byte) {
-	for nalu := range naluChan {
-		cm.cacheKeyframes(nalu)
+// SetKeyframeRequester attaches the source that viewer keyframe requests are forwarded to
+func (cm *ClientManager) SetKeyframeRequester(kr KeyframeRequester) {
+	cm.Mu.Lock()
+	cm.keyframeRequester = kr
+	cm.Mu.Unlock()
+}
+
+// BroadcastFrames fans frames from the camera out to the recorder and all clients
+func (cm *ClientManager) BroadcastFrames(frameChan <-chan *Frame) {
+	for frame := range frameChan {
+		cm.Mu.Lock()
+		cm.cacheKeyframes(frame)
+		cm.Mu.Unlock()
 
 		cm.Mu.RLock()
 
 		// Send to recorder (non-blocking)
 		if cm.recorder != nil {
 			select {
-			case cm.recorder.GetNALUChannel() <- nalu:
+			case cm.recorder.GetFrameChannel() <- frame:
 			default:
 				// Recorder can't keep up, skip frame
 			}
 		}
 
-		// Send to clients
+		// Send to clients. Congested clients get whole keyframes only, which start
+		// with the cached SPS/PPS so decoding resumes cleanly; that frame is only
+		// built if one of them needs it.
+		keyframe := lazyKeyframe{cm: cm}
 		for c := range cm.Clients {
-			select {
-			case c.naluChan <- nalu:
-			default:
-				// Client can't keep up, skip frame
-				atomic.AddUint64(&c.droppedFrames, 1)
-			}
+			c.enqueue(frame, &keyframe)
 		}
 		cm.Mu.RUnlock()
 	}
 }
 
-func (cm *ClientManager) cacheKeyframes(nalu []byte) {
-	if len(nalu) < 5 {
-		return
-	}
-	naluType := nalu[4] & 0x1F
-	switch naluType {
-	case 7: // SPS
-		// Only copy if changed to avoid unnecessary allocations
-		if !bytes.Equal(cm.lastSPS, nalu) {
-			cm.lastSPS = make([]byte, len(nalu))
-			copy(cm.lastSPS, nalu)
-		}
-	case 8: // PPS
-		if !bytes.Equal(cm.lastPPS, nalu) {
-			cm.lastPPS = make([]byte, len(nalu))
-			copy(cm.lastPPS, nalu)
+// cacheKeyframes remembers the latest SPS, PPS and IDR frame. Caller must hold Mu.
+func (cm *ClientManager) cacheKeyframes(frame *Frame) {
+	for _, nalu := range frame.NALUs {
+		switch naluType(nalu) {
+		case naluTypeSPS:
+			// Only copy if changed to avoid unnecessary allocations
+			if !bytes.Equal(cm.lastSPS, nalu) {
+				cm.lastSPS = make([]byte, len(nalu))
+				copy(cm.lastSPS, nalu)
+			}
+		case naluTypePPS:
+			if !bytes.Equal(cm.lastPPS, nalu) {
+				cm.lastPPS = make([]byte, len(nalu))
+				copy(cm.lastPPS, nalu)
+			}
 		}
-	case 5: // IDR
-		// Always update IDR as each keyframe is different
-		cm.lastKeyframe = make([]byte, len(nalu))
-		copy(cm.lastKeyframe, nalu)
 	}
-}
 
-func (cm *ClientManager) AddClient(client *Client) {
-	cm.Mu.Lock()
-	cm.Clients[client] = struct{}{}
-	cm.Mu.Unlock()
+	// Frames are never modified after assembly, so the IDR frame can be shared
+	if frame.Keyframe {
+		cm.lastKeyframe = frame
+	}
+}
 
-	// Send cached keyframes immediately (use MTU and set proper timestamp)
-	// advance timestamp for each logical frame sent to keep monotonic RTP timestamps
-	if client.tsInc == 0 {
-		// fallback to 30fps if not set
-		client.tsInc = 90000 / 30
+// keyframeFrame builds a frame that lets a decoder start from scratch:
+// the cached SPS and PPS followed by the slices of the last IDR frame.
+// Returns nil until a complete set has been seen. Caller must hold Mu.
+func (cm *ClientManager) keyframeFrame() *Frame {
+	if cm.lastSPS == nil || cm.lastPPS == nil || cm.lastKeyframe == nil {
+		return nil
 	}
-	if cm.lastSPS != nil {
-		client.lastTimestamp += client.tsInc
-		packets := client.Packetizer.Packetize(cm.lastSPS, maxPayloadSize)
-		for _, pkt := range packets {
-			pkt.Header.Timestamp = client.lastTimestamp
-			if err := client.VideoTrack.WriteRTP(pkt); err != nil {
-				log.Printf("WriteRTP error (SPS): %v", err)
-			}
-		}
+
+	frame := &Frame{
+		Keyframe:  true,
+		Timestamp: cm.lastKeyframe.Timestamp,
 	}
-	if cm.lastPPS != nil {
-		client.lastTimestamp += client.tsInc
-		packets := client.Packetizer.Packetize(cm.lastPPS, maxPayloadSize)
-		for _, pkt := range packets {
-			pkt.Header.Timestamp = client.lastTimestamp
-			if err := client.VideoTrack.WriteRTP(pkt); err != nil {
-				log.Printf("WriteRTP error (PPS): %v", err)
-			}
+	frame.Data = append(frame.Data, cm.lastSPS...)
+	frame.Data = append(frame.Data, cm.lastPPS...)
+	for _, nalu := range cm.lastKeyframe.NALUs {
+		switch naluType(nalu) {
+		case naluTypeSPS, naluTypePPS, naluTypeAUD:
+			continue
 		}
+		frame.Data = append(frame.Data, nalu...)
 	}
-	if cm.lastKeyframe != nil {
-		client.lastTimestamp += client.tsInc
-		packets := client.Packetizer.Packetize(cm.lastKeyframe, maxPayloadSize)
-		for _, pkt := range packets {
-			pkt.Header.Timestamp = client.lastTimestamp
-			if err := client.VideoTrack.WriteRTP(pkt); err != nil {
-				log.Printf("WriteRTP error (Keyframe): %v", err)
-			}
-		}
+	frame.NALUs, _ = splitNALUs(frame.Data)
+	return frame
+}
+
+// lazyKeyframe builds keyframeFrame at most once per broadcast frame, on first use
+type lazyKeyframe struct {
+	cm    *ClientManager
+	frame *Frame
+	built bool
+}
+
+// get returns the cached SPS/PPS/IDR frame. Caller must hold cm.Mu.
+func (k *lazyKeyframe) get() *Frame {
+	if !k.built {
+		k.frame = k.cm.keyframeFrame()
+		k.built = true
 	}
+	return k.frame
+}
+
+// AddClient starts sending frames to the client. The cached keyframe goes first,
+// once the connection is up: written before then, it would reach no one.
+func (cm *ClientManager) AddClient(client *Client) {
+	cm.Mu.Lock()
+	cm.Clients[client] = struct{}{}
+	cm.Mu.Unlock()
 
 	// Start per-client sender goroutine
 	client.wg.Add(1)
@@ -162,30 +239,29 @@ func (cm *ClientManager) AddClient(client *Client) {
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
 
+		// Set to nil once the join keyframe has been sent
+		connected := client.connected
+
 		for {
 			select {
-			case nalu, ok := <-client.naluChan:
+			case <-connected:
+				connected = nil
+				cm.sendKeyframe(client)
+			case frame, ok := <-client.frameChan:
 				if !ok {
 					return
 				}
 				if client.PeerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
-					// Advance timestamp once per frame for monotonic timestamps
-					if client.tsInc == 0 {
-						client.tsInc = 90000 / 30 // fallback
-					}
-					client.lastTimestamp += client.tsInc
-					timestamp := client.lastTimestamp
-
-					packets := client.Packetizer.Packetize(nalu, maxPayloadSize)
-					for _, pkt := range packets {
-						pkt.Header.Timestamp = timestamp
-						if err := client.VideoTrack.WriteRTP(pkt); err != nil {
-							// Log but don't block; underlying connection state will handle cleanup
-							log.Printf("WriteRTP error: %v", err)
-						}
+					if connected != nil {
+						// Connected before the signal was picked up
+						connected = nil
+						cm.sendKeyframe(client)
 					}
+					client.writeFrame(frame)
 					atomic.AddUint64(&client.sentFrames, 1)
 				}
+			case <-client.keyframeRequest:
+				cm.resendKeyframe(client)
 			case <-ticker.C:
 				// Send stats every second
 				client.dcMu.RLock()
@@ -195,11 +271,23 @@ func (cm *ClientManager) AddClient(client *Client) {
 				if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
 					sent := atomic.LoadUint64(&client.sentFrames)
 					dropped := atomic.LoadUint64(&client.droppedFrames)
+					congested, estimateBps := client.congestion.state()
 
 					stats := FrameStats{
 						SentFrames:    sent,
 						DroppedFrames: dropped,
 						Timestamp:     time.Now().UnixMilli(),
+						CaptureTime:   atomic.LoadInt64(&client.lastCaptureMs),
+						LatencyMs:     float64(atomic.LoadInt64(&client.latencyUs)) / 1000,
+						PLICount:      atomic.LoadUint64(&client.pliCount),
+						FIRCount:      atomic.LoadUint64(&client.firCount),
+						NACKCount:     atomic.LoadUint64(&client.nackCount),
+						FractionLost:  float64(atomic.LoadUint32(&client.fractionLost)) / 256,
+						PacketsLost:   atomic.LoadUint32(&client.packetsLost),
+						JitterMs:      float64(atomic.LoadUint32(&client.jitter)) / 90,
+						RTTMs:         float64(atomic.LoadInt64(&client.rttUs)) / 1000,
+						Congested:     congested,
+						EstimateKbps:  estimateBps / 1000,
 					}
 					data, err := json.Marshal(stats)
 					if err == nil {
@@ -230,8 +318,205 @@ func (cm *ClientManager) RemoveClient(client *Client) {
 	// Wait for sender goroutine to finish
 	client.wg.Wait()
 
-	// Close NALU channel
-	close(client.naluChan)
+	// Close frame channel
+	close(client.frameChan)
+}
+
+// enqueue queues a frame for the client unless its congestion policy drops it.
+// keyframe supplies the cached SPS/PPS/IDR in place of a keyframe.
+func (c *Client) enqueue(frame *Frame, keyframe *lazyKeyframe) {
+	switch c.congestion.admit(frame, len(c.frameChan)) {
+	case dropFrame:
+		atomic.AddUint64(&c.droppedFrames, 1)
+		return
+	case deliverKeyframe:
+		if k := keyframe.get(); k != nil {
+			frame = k
+		}
+	}
+
+	select {
+	case c.frameChan <- frame:
+	default:
+		// Client can't keep up; drop the rest of the GOP rather than leave a gap mid-GOP
+		atomic.AddUint64(&c.droppedFrames, 1)
+		c.congestion.markCongested()
+	}
+}
+
+// resendKeyframe answers a viewer's PLI/FIR with the cached SPS/PPS/IDR and asks
+// the source for a fresh IDR. Must be called from the client's sender goroutine.
+func (cm *ClientManager) resendKeyframe(client *Client) {
+	now := time.Now()
+	if now.Sub(client.lastKeyframeResend) < keyframeResendInterval {
+		return
+	}
+	client.lastKeyframeResend = now
+
+	if client.PeerConn.ConnectionState() == webrtc.PeerConnectionStateConnected {
+		cm.sendKeyframe(client)
+	}
+
+	cm.requestSourceKeyframe()
+}
+
+// sendKeyframe writes the cached SPS/PPS/IDR as one frame, so they share a
+// timestamp. The frames still queued are dropped first: they were captured
+// before it, and written after it they would all get the RTP timestamp
+// following its own. It takes the newest capture time sent or dropped so far,
+// so the RTP clock keeps following capture time. Must be called from the
+// client's sender goroutine.
+func (cm *ClientManager) sendKeyframe(client *Client) {
+	cm.Mu.RLock()
+	keyframe := cm.keyframeFrame()
+	cm.Mu.RUnlock()
+	if keyframe == nil {
+		return
+	}
+
+	newest := client.lastCapture
+	for drained := false; !drained; {
+		select {
+		case frame, ok := <-client.frameChan:
+			if !ok {
+				return
+			}
+			atomic.AddUint64(&client.droppedFrames, 1)
+			if frame.Timestamp.After(newest) {
+				newest = frame.Timestamp
+			}
+		default:
+			drained = true
+		}
+	}
+	if newest.IsZero() {
+		newest = time.Now()
+	}
+
+	keyframe.Timestamp = newest
+	client.writeFrame(keyframe)
+}
+
+// requestSourceKeyframe forwards a keyframe request to the source,
+// at most once per sourceKeyframeInterval across all viewers.
+func (cm *ClientManager) requestSourceKeyframe() {
+	cm.Mu.Lock()
+	kr := cm.keyframeRequester
+	if kr == nil || time.Since(cm.lastSourceKeyframe) < sourceKeyframeInterval {
+		cm.Mu.Unlock()
+		return
+	}
+	cm.lastSourceKeyframe = time.Now()
+	cm.Mu.Unlock()
+
+	if err := kr.RequestKeyframe(); err != nil && err != ErrKeyframeUnsupported {
+		log.Printf("Keyframe request to source failed: %v", err)
+	}
+}
+
+// readRTCP consumes RTCP from the viewer until the sender is closed. PLI and FIR
+// feedback become keyframe requests for the sender goroutine; receiver reports
+// update the loss, jitter and RTT figures sent in FrameStats. NACKs have already
+// been answered by the NACK responder interceptor and are only counted here.
+// ssrc is the sender's video SSRC, which receiver reports refer to.
+func (c *Client) readRTCP(sender *webrtc.RTPSender, ssrc uint32) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range packets {
+			switch p := pkt.(type) {
+			case *rtcp.ReceiverReport:
+				c.handleReceptionReports(p.Reports, ssrc)
+				continue
+			case *rtcp.TransportLayerNack:
+				atomic.AddUint64(&c.nackCount, 1)
+				continue
+			case *rtcp.PictureLossIndication:
+				atomic.AddUint64(&c.pliCount, 1)
+			case *rtcp.FullIntraRequest:
+				atomic.AddUint64(&c.firCount, 1)
+			default:
+				continue
+			}
+			select {
+			case c.keyframeRequest <- struct{}{}:
+			default:
+				// A request is already pending
+			}
+		}
+	}
+}
+
+// handleReceptionReports stores the viewer's report about our video SSRC
+func (c *Client) handleReceptionReports(reports []rtcp.ReceptionReport, ssrc uint32) {
+	for _, report := range reports {
+		if report.SSRC != ssrc {
+			continue
+		}
+		atomic.StoreUint32(&c.fractionLost, uint32(report.FractionLost))
+		c.congestion.onReceiverReport(report.FractionLost)
+		atomic.StoreUint32(&c.packetsLost, report.TotalLost)
+		atomic.StoreUint32(&c.jitter, report.Jitter)
+
+		// RTT = arrival time - LSR - DLSR, all in 1/65536s NTP short format.
+		// LSR is 0 until the viewer has received a sender report.
+		if report.LastSenderReport != 0 {
+			rtt := int32(ntpShort(time.Now()) - report.LastSenderReport - report.Delay)
+			if rtt >= 0 {
+				atomic.StoreInt64(&c.rttUs, int64(rtt)*1000000/65536)
+			}
+		}
+	}
+}
+
+// ntpShort returns the middle 32 bits of the NTP timestamp for t (16.16 fixed-point seconds)
+func ntpShort(t time.Time) uint32 {
+	const ntpEpochOffset = 2208988800 // Seconds from 1900-01-01 to 1970-01-01
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := (uint64(t.Nanosecond()) << 32) / 1000000000
+	return uint32(secs<<16 | frac>>16)
+}
+
+// writeFrame packetizes a whole access unit with a single RTP timestamp
+// derived from its capture time. The payloader aggregates SPS/PPS into a
+// STAP-A and the packetizer sets the marker bit on the last packet of the frame only.
+func (c *Client) writeFrame(frame *Frame) {
+	timestamp := c.rtpTimestamp(frame.Timestamp)
+
+	packets := c.Packetizer.Packetize(frame.Data, 0)
+	for _, pkt := range packets {
+		pkt.Header.Timestamp = timestamp
+		if err := c.VideoTrack.WriteRTP(pkt); err != nil {
+			// Log but don't block; underlying connection state will handle cleanup
+			log.Printf("WriteRTP error: %v", err)
+		}
+	}
+
+	c.lastCapture = frame.Timestamp
+	atomic.StoreInt64(&c.lastCaptureMs, frame.Timestamp.UnixMilli())
+	atomic.StoreInt64(&c.latencyUs, time.Since(frame.Timestamp).Microseconds())
+}
+
+// rtpTimestamp maps a monotonic capture time onto the client's 90kHz RTP clock.
+// Frames captured before the previously sent one still get a strictly
+// increasing timestamp.
+func (c *Client) rtpTimestamp(capture time.Time) uint32 {
+	elapsed := capture.Sub(c.startTime)
+	// 90000 ticks per second = 9 ticks per 100µs; negative offsets wrap like RTP does
+	ts := c.tsBase + uint32(elapsed.Microseconds()*9/100)
+	if c.sentAny && int32(ts-c.lastTimestamp) <= 0 {
+		ts = c.lastTimestamp + 1
+	}
+	c.sentAny = true
+	c.lastTimestamp = ts
+	return ts
+}
+
+// markConnected tells the sender goroutine the connection is up. Safe to call more than once.
+func (c *Client) markConnected() {
+	c.connectOnce.Do(func() { close(c.connected) })
 }
 
 // SetDataChannel safely sets the data channel for a client
@@ -241,30 +526,27 @@ func (c *Client) SetDataChannel(dc *webrtc.DataChannel) {
 	c.dcMu.Unlock()
 }
 
-func NewClient(pc *webrtc.PeerConnection, track *webrtc.TrackLocalStaticRTP, dc *webrtc.DataChannel, fps int) *Client {
+func NewClient(pc *webrtc.PeerConnection, track *webrtc.TrackLocalStaticRTP, dc *webrtc.DataChannel) *Client {
 	ssrc := rand.Uint32()
 	packetizer := rtp.NewPacketizer(
 		maxPayloadSize, 96, ssrc, &codecs.H264Payloader{},
 		rtp.NewRandomSequencer(), 90000,
 	)
-	// Increase per-client NALU buffer to tolerate bursts
-	naluChan := make(chan []byte, 500)
+	// Per-client frame buffer (~5s at 30fps); congestion control keeps it far shorter
+	frameChan := make(chan *Frame, 150)
 	done := make(chan struct{})
 
-	if fps <= 0 {
-		fps = 30
-	}
-	tsInc := uint32(90000 / fps)
-
 	return &Client{
-		PeerConn:      pc,
-		VideoTrack:    track,
-		DataChannel:   dc,
-		Packetizer:    packetizer,
-		lastTimestamp: 0,
-		tsInc:         tsInc,
-		startTime:     time.Now(),
-		naluChan:      naluChan,
-		done:          done,
+		PeerConn:        pc,
+		VideoTrack:      track,
+		DataChannel:     dc,
+		Packetizer:      packetizer,
+		lastTimestamp:   0,
+		tsBase:          rand.Uint32(),
+		startTime:       time.Now(),
+		frameChan:       frameChan,
+		done:            done,
+		connected:       make(chan struct{}),
+		keyframeRequest: make(chan struct{}, 1),
 	}
 }
@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// MP4 (ISO BMFF, ISO/IEC 14496-12) muxing of H264 access units as they are,
+// without re-encoding. Samples are stored in AVCC form: each NAL unit prefixed
+// with its 4-byte length instead of an Annex-B start code.
+//
+// Two layouts are written: fragmented MP4 while recording (an init segment,
+// then a moof/mdat pair per GOP, playable at any point), and a regular MP4
+// with the moov first once the recording is finished.
+
+const (
+	mp4Timescale       = 90000 // Track timescale, the 90kHz clock also used for RTP video
+	mp4MovieTimescale  = 1000  // Movie header timescale (ms)
+	mp4SamplesPerChunk = 30
+)
+
+// Seconds between the MP4 epoch (1904-01-01) and the Unix epoch
+const mp4EpochOffset = 2082844800
+
+// mp4Sample is one access unit of the video track
+type mp4Sample struct {
+	Size     uint32 // Bytes in AVCC form
+	Duration uint32 // In mp4Timescale units
+	Keyframe bool
+}
+
+// mp4Track describes the single H264 video track of an MP4 file
+type mp4Track struct {
+	SPS     []byte // Parameter sets without start codes, stored in the avcC box
+	PPS     []byte
+	Width   int
+	Height  int
+	Created time.Time
+	Samples []mp4Sample
+
+	// From the SPS, for the avcC of High profiles
+	ChromaFormatIDC uint32
+	BitDepthLuma    uint32
+	BitDepthChroma  uint32
+}
+
+// newMP4Track returns an empty track for the stream described by sps and pps (Annex-B or bare)
+func newMP4Track(sps, pps []byte, created time.Time) (*mp4Track, error) {
+	info, err := ParseSPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	return &mp4Track{
+		SPS:             naluPayload(sps),
+		PPS:             naluPayload(pps),
+		Width:           info.Width,
+		Height:          info.Height,
+		Created:         created,
+		ChromaFormatIDC: info.ChromaFormatIDC,
+		BitDepthLuma:    info.BitDepthLuma,
+		BitDepthChroma:  info.BitDepthChroma,
+	}, nil
+}
+
+// duration returns the track duration in mp4Timescale units
+func (t *mp4Track) duration() uint64 {
+	var d uint64
+	for _, s := range t.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+// writeMP4Header writes ftyp, a moov describing every sample and the mdat header.
+// The caller then writes the samples in order, in AVCC form. The moov comes
+// first ("faststart") so players can start before the whole file is loaded.
+func writeMP4Header(w io.Writer, t *mp4Track) error {
+	if len(t.Samples) == 0 {
+		return fmt.Errorf("no samples to write")
+	}
+	var mdatSize uint64
+	for _, s := range t.Samples {
+		mdatSize += uint64(s.Size)
+	}
+
+	ftyp := mp4Ftyp()
+	mdatHeader := mp4BoxHeader("mdat", mdatSize)
+
+	// Chunk offsets are absolute, so the moov is built once to learn its size.
+	// Its size does not depend on the offsets, only on whether they need 64 bits.
+	large := false
+	moov := t.moov(0, large)
+	if uint64(len(ftyp)+len(moov)+len(mdatHeader))+mdatSize > math.MaxUint32 {
+		large = true
+		moov = t.moov(0, large)
+	}
+	moov = t.moov(uint64(len(ftyp)+len(moov)+len(mdatHeader)), large)
+
+	for _, b := range [][]byte{ftyp, moov, mdatHeader} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mp4Ftyp() []byte {
+	return mp4Box("ftyp",
+		[]byte("isom"), be32(0x200),
+		[]byte("isom"), []byte("iso2"), []byte("avc1"), []byte("mp41"))
+}
+
+// writeMP4Init writes the init segment of a fragmented MP4: ftyp and a moov
+// without samples, announcing that they follow in movie fragments
+func writeMP4Init(w io.Writer, t *mp4Track) (int, error) {
+	empty := *t
+	empty.Samples = nil
+	moov := empty.moov(0, false)
+
+	// mvex/trex sets the defaults the fragments rely on
+	trex := mp4FullBox("trex", 0, 0, be32(1), be32(1), be32(0), be32(0), be32(0)) // track 1, sample description 1
+	mvex := mp4Box("mvex", trex)
+	moov = append(mp4BoxHeader("moov", uint64(len(moov)-8+len(mvex))), moov[8:]...)
+	moov = append(moov, mvex...)
+
+	return w.Write(append(mp4Ftyp(), moov...))
+}
+
+// mp4Fragment returns the moof and mdat header of a movie fragment holding
+// samples, which must follow in AVCC form. baseTime is the decode time of the
+// first sample; seq numbers the fragments from 1.
+func mp4Fragment(seq uint32, baseTime uint64, samples []mp4Sample) []byte {
+	var mdatSize uint64
+	trun := make([]byte, 0, 12*len(samples))
+	for _, s := range samples {
+		flags := uint32(0x01010000) // depends on other samples, not a sync sample
+		if s.Keyframe {
+			flags = 0x02000000 // depends on no other sample
+		}
+		trun = append(trun, be32(s.Duration)...)
+		trun = append(trun, be32(s.Size)...)
+		trun = append(trun, be32(flags)...)
+		mdatSize += uint64(s.Size)
+	}
+
+	// The data offset is relative to the moof (default-base-is-moof), so it is
+	// the moof size plus the mdat header; the trun's size does not depend on it
+	build := func(dataOffset uint32) []byte {
+		return mp4Box("moof",
+			mp4FullBox("mfhd", 0, 0, be32(seq)),
+			mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, be32(1)), // default-base-is-moof, track 1
+				mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, baseTime)),
+				mp4FullBox("trun", 0, 0x000701, be32(uint32(len(samples))), be32(dataOffset), trun))) // data offset, sample duration, size and flags
+	}
+	mdatHeader := mp4BoxHeader("mdat", mdatSize)
+	moof := build(0)
+	moof = build(uint32(len(moof) + len(mdatHeader)))
+	return append(moof, mdatHeader...)
+}
+
+// moov builds the movie box; mdatStart is the file offset of the first sample
+func (t *mp4Track) moov(mdatStart uint64, large bool) []byte {
+	created := uint32(0)
+	if !t.Created.IsZero() {
+		created = uint32(t.Created.Unix() + mp4EpochOffset)
+	}
+	duration := t.duration()
+	movieDuration := uint32(duration * mp4MovieTimescale / mp4Timescale)
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		be32(created), be32(created), be32(mp4MovieTimescale), be32(movieDuration),
+		be32(0x00010000), be16(0x0100), make([]byte, 10), // rate 1.0, volume 1.0, reserved
+		mp4Matrix(), make([]byte, 24), // pre_defined
+		be32(2)) // next_track_ID
+
+	tkhd := mp4FullBox("tkhd", 0, 3, // track enabled, in movie
+		be32(created), be32(created), be32(1), be32(0), be32(movieDuration),
+		make([]byte, 8), be16(0), be16(0), be16(0), be16(0), // reserved, layer, alternate_group, volume, reserved
+		mp4Matrix(), be32(uint32(t.Width)<<16), be32(uint32(t.Height)<<16))
+
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		be32(created), be32(created), be32(mp4Timescale), be32(uint32(duration)),
+		be16(0x55C4), be16(0)) // language "und"
+
+	hdlr := mp4FullBox("hdlr", 0, 0,
+		be32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+
+	minf := mp4Box("minf",
+		mp4FullBox("vmhd", 0, 1, make([]byte, 8)),
+		mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1))), // Media is in this file
+		t.stbl(mdatStart, large))
+
+	return mp4Box("moov", mvhd, mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf)))
+}
+
+// stbl builds the sample table: timing (stts), keyframes (stss), sizes (stsz)
+// and where the chunks of mp4SamplesPerChunk samples start (stco/co64)
+func (t *mp4Track) stbl(mdatStart uint64, large bool) []byte {
+	var stts []byte
+	var entries uint32
+	for i := 0; i < len(t.Samples); {
+		j := i
+		for j < len(t.Samples) && t.Samples[j].Duration == t.Samples[i].Duration {
+			j++
+		}
+		stts = append(stts, be32(uint32(j-i))...)
+		stts = append(stts, be32(t.Samples[i].Duration)...)
+		entries++
+		i = j
+	}
+
+	var stss []byte
+	var keyframes uint32
+	stsz := make([]byte, 0, 4*len(t.Samples))
+	for i, s := range t.Samples {
+		if s.Keyframe {
+			stss = append(stss, be32(uint32(i+1))...)
+			keyframes++
+		}
+		stsz = append(stsz, be32(s.Size)...)
+	}
+
+	chunks := (len(t.Samples) + mp4SamplesPerChunk - 1) / mp4SamplesPerChunk
+	var stsc []byte
+	var stscEntries uint32
+	if chunks > 0 {
+		stsc = append(be32(1), be32(mp4SamplesPerChunk)...)
+		stsc = append(stsc, be32(1)...)
+		stscEntries = 1
+	}
+	if rest := len(t.Samples) % mp4SamplesPerChunk; rest != 0 {
+		if chunks == 1 {
+			stsc = stsc[:0]
+			stscEntries = 0
+		}
+		stsc = append(stsc, be32(uint32(chunks))...)
+		stsc = append(stsc, be32(uint32(rest))...)
+		stsc = append(stsc, be32(1)...)
+		stscEntries++
+	}
+
+	offsetType := "stco"
+	if large {
+		offsetType = "co64"
+	}
+	offsets := be32(uint32(chunks))
+	offset := mdatStart
+	for i, s := range t.Samples {
+		if i%mp4SamplesPerChunk == 0 {
+			if large {
+				offsets = binary.BigEndian.AppendUint64(offsets, offset)
+			} else {
+				offsets = append(offsets, be32(uint32(offset))...)
+			}
+		}
+		offset += uint64(s.Size)
+	}
+
+	boxes := [][]byte{
+		mp4FullBox("stsd", 0, 0, be32(1), t.avc1()),
+		mp4FullBox("stts", 0, 0, be32(entries), stts),
+	}
+	// Without stss every sample is a keyframe
+	if int(keyframes) != len(t.Samples) {
+		boxes = append(boxes, mp4FullBox("stss", 0, 0, be32(keyframes), stss))
+	}
+	boxes = append(boxes,
+		mp4FullBox("stsc", 0, 0, be32(stscEntries), stsc),
+		mp4FullBox("stsz", 0, 0, be32(0), be32(uint32(len(t.Samples))), stsz),
+		mp4FullBox(offsetType, 0, 0, offsets))
+	return mp4Box("stbl", boxes...)
+}
+
+// avc1 builds the H264 sample entry with its decoder configuration (avcC, ISO/IEC 14496-15)
+func (t *mp4Track) avc1() []byte {
+	avcC := []byte{
+		1,                            // configurationVersion
+		t.SPS[1], t.SPS[2], t.SPS[3], // profile, compatibility, level
+		0xFF,     // lengthSizeMinusOne = 3
+		0xE0 | 1, // one SPS
+	}
+	avcC = append(avcC, be16(uint16(len(t.SPS)))...)
+	avcC = append(avcC, t.SPS...)
+	avcC = append(avcC, 1) // one PPS
+	avcC = append(avcC, be16(uint16(len(t.PPS)))...)
+	avcC = append(avcC, t.PPS...)
+	// High profiles also carry the chroma format and bit depths, as in their SPS
+	if hasChromaFormatInfo(t.SPS[1]) {
+		avcC = append(avcC,
+			0xFC|byte(t.ChromaFormatIDC&0x03),
+			0xF8|byte((t.BitDepthLuma-8)&0x07),
+			0xF8|byte((t.BitDepthChroma-8)&0x07),
+			0) // no SPS extensions
+	}
+
+	compressor := make([]byte, 32)
+	return mp4Box("avc1",
+		make([]byte, 6), be16(1), // reserved, data_reference_index
+		make([]byte, 16), // pre_defined, reserved
+		be16(uint16(t.Width)), be16(uint16(t.Height)),
+		be32(0x00480000), be32(0x00480000), // 72 dpi
+		be32(0), be16(1), compressor, // reserved, frame_count
+		be16(0x0018), be16(0xFFFF), // depth, pre_defined = -1
+		mp4Box("avcC", avcC))
+}
+
+// mp4Box returns a box of the given type containing payload
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := mp4BoxHeader(typ, uint64(size))
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// mp4FullBox returns a box with a version and flags ahead of payload
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+// mp4BoxHeader returns the header of a box with payloadSize bytes of payload,
+// using a 64-bit size when it does not fit in 32 bits
+func mp4BoxHeader(typ string, payloadSize uint64) []byte {
+	if payloadSize+8 > math.MaxUint32 {
+		b := append(be32(1), typ...)
+		return binary.BigEndian.AppendUint64(b, payloadSize+16)
+	}
+	return append(be32(uint32(payloadSize+8)), typ...)
+}
+
+// mp4Matrix is the identity transformation matrix of mvhd and tkhd
+func mp4Matrix() []byte {
+	var m []byte
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		m = append(m, be32(v)...)
+	}
+	return m
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func be16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+var annexBStartCode = []byte{0, 0, 1}
+
+// forEachNALU calls fn with every NAL unit in Annex-B data, without start codes
+func forEachNALU(data []byte, fn func(nalu []byte)) {
+	i := bytes.Index(data, annexBStartCode)
+	for i >= 0 {
+		start := i + 3
+		next := bytes.Index(data[start:], annexBStartCode)
+		end := len(data)
+		if next >= 0 {
+			end = start + next
+		}
+		// Zero bytes before the next start code belong to it (4-byte start code) or are padding
+		nalu := bytes.TrimRight(data[start:end], "\x00")
+		if len(nalu) > 0 {
+			fn(nalu)
+		}
+		if next < 0 {
+			break
+		}
+		i = end
+	}
+}
+
+// avccSize returns the size of an Annex-B access unit in AVCC form
+func avccSize(au []byte) int {
+	size := 0
+	forEachNALU(au, func(nalu []byte) {
+		size += 4 + len(nalu)
+	})
+	return size
+}
+
+// appendAVCC appends an Annex-B access unit to dst in AVCC form
+func appendAVCC(dst, au []byte) []byte {
+	forEachNALU(au, func(nalu []byte) {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(nalu)))
+		dst = append(dst, nalu...)
+	})
+	return dst
+}
@@ -0,0 +1,451 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testBox is a box split out of MP4 data by splitBoxes
+type testBox struct {
+	typ     string
+	payload []byte
+}
+
+// splitBoxes splits data into consecutive boxes, which must fill it exactly
+func splitBoxes(t *testing.T, data []byte) []testBox {
+	t.Helper()
+	var boxes []testBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%d bytes left after the last box", len(data))
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		if size == 1 {
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			t.Fatalf("%s box of %d bytes in %d", data[4:8], size, len(data))
+		}
+		boxes = append(boxes, testBox{typ: string(data[4:8]), payload: data[header:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// findBox returns the payload of the box at path below data. The fields that
+// stsd and avc1 hold ahead of their child boxes are skipped on the way down.
+func findBox(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for i, typ := range path {
+		var found []byte
+		for _, box := range splitBoxes(t, data) {
+			if box.typ == typ {
+				found = box.payload
+				break
+			}
+		}
+		if found == nil {
+			t.Fatalf("no %s box in %v", typ, path[:i])
+		}
+		data = found
+		if i < len(path)-1 {
+			switch typ {
+			case "stsd":
+				data = data[8:] // version, flags, entry_count
+			case "avc1":
+				data = data[78:] // VisualSampleEntry fields
+			}
+		}
+	}
+	return data
+}
+
+// hasBox reports whether the container data holds a box of the type
+func hasBox(t *testing.T, data []byte, typ string) bool {
+	t.Helper()
+	for _, box := range splitBoxes(t, data) {
+		if box.typ == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// u32s reads the big-endian 32-bit fields of a full box payload, after its version and flags
+func u32s(payload []byte) []uint32 {
+	var v []uint32
+	for i := 4; i+4 <= len(payload); i += 4 {
+		v = append(v, binary.BigEndian.Uint32(payload[i:]))
+	}
+	return v
+}
+
+func TestMP4AvcC(t *testing.T) {
+	tests := []struct {
+		name   string
+		sps    []byte
+		pps    []byte
+		width  uint16
+		height uint16
+		ext    []byte // chroma_format, bit depths and SPS extension count
+	}{
+		{"baseline", testSPSBaseline, testPPSCAVLC, 640, 480, nil},
+		{"high 720p", testSPSHigh720, testPPSCABAC, 1280, 720, []byte{0xfd, 0xf8, 0xf8, 0x00}},
+		{"high cropped 1080p", testSPSHigh1080, testPPSCABAC, 1920, 1080, []byte{0xfd, 0xf8, 0xf8, 0x00}},
+		{"high 4:2:2 10-bit", testSPSHigh422, testPPSCABAC, 1920, 1080, []byte{0xfe, 0xfa, 0xfa, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Annex-B parameter sets, as cached from the stream
+			track, err := newMP4Track(append([]byte{0, 0, 0, 1}, tt.sps...), append([]byte{0, 0, 0, 1}, tt.pps...), time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := track.avc1()
+
+			avc1 := findBox(t, entry, "avc1")
+			if w, h := binary.BigEndian.Uint16(avc1[24:]), binary.BigEndian.Uint16(avc1[26:]); w != tt.width || h != tt.height {
+				t.Errorf("avc1 size %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+
+			want := []byte{1, tt.sps[1], tt.sps[2], tt.sps[3], 0xff, 0xe1}
+			want = append(want, be16(uint16(len(tt.sps)))...)
+			want = append(want, tt.sps...)
+			want = append(want, 1)
+			want = append(want, be16(uint16(len(tt.pps)))...)
+			want = append(want, tt.pps...)
+			want = append(want, tt.ext...)
+			if got := findBox(t, entry, "avc1", "avcC"); !bytes.Equal(got, want) {
+				t.Errorf("avcC\n got % x\nwant % x", got, want)
+			}
+		})
+	}
+}
+
+// testSamples returns n samples of sizes 100, 101, ... with a keyframe every
+// 30, lasting 3000 ticks for the first 40 and 3003 after
+func testSamples(n int) []mp4Sample {
+	samples := make([]mp4Sample, n)
+	for i := range samples {
+		samples[i] = mp4Sample{Size: uint32(100 + i), Duration: 3000, Keyframe: i%30 == 0}
+		if i >= 40 {
+			samples[i].Duration = 3003
+		}
+	}
+	return samples
+}
+
+func TestMP4SampleTable(t *testing.T) {
+	const mdatStart = 1000
+	tests := []struct {
+		name    string
+		samples []mp4Sample
+		stts    []uint32 // entry_count, then sample_count/sample_delta pairs
+		stss    []uint32 // nil when every sample is a keyframe
+		stsc    []uint32 // entry_count, then first_chunk/samples_per_chunk/sample_description_index
+		chunks  []int    // First sample of each chunk
+	}{
+		{
+			name:    "single sample",
+			samples: []mp4Sample{{Size: 50, Duration: 3000, Keyframe: true}},
+			stts:    []uint32{1, 1, 3000},
+			stsc:    []uint32{1, 1, 1, 1},
+			chunks:  []int{0},
+		},
+		{
+			name:    "partial chunk",
+			samples: testSamples(10),
+			stts:    []uint32{1, 10, 3000},
+			stss:    []uint32{1, 1},
+			stsc:    []uint32{1, 1, 10, 1},
+			chunks:  []int{0},
+		},
+		{
+			name:    "whole chunks",
+			samples: testSamples(60),
+			stts:    []uint32{2, 40, 3000, 20, 3003},
+			stss:    []uint32{2, 1, 31},
+			stsc:    []uint32{1, 1, 30, 1},
+			chunks:  []int{0, 30},
+		},
+		{
+			name:    "whole chunks and a partial one",
+			samples: testSamples(65),
+			stts:    []uint32{2, 40, 3000, 25, 3003},
+			stss:    []uint32{3, 1, 31, 61},
+			stsc:    []uint32{2, 1, 30, 1, 3, 5, 1},
+			chunks:  []int{0, 30, 60},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track := &mp4Track{SPS: testSPSBaseline, PPS: testPPSCAVLC, Width: 640, Height: 480, Samples: tt.samples}
+
+			// Chunk offsets are the same in 32 and 64 bits
+			var offsets []uint64
+			offset := uint64(mdatStart)
+			for i, s := range tt.samples {
+				if len(offsets) < len(tt.chunks) && tt.chunks[len(offsets)] == i {
+					offsets = append(offsets, offset)
+				}
+				offset += uint64(s.Size)
+			}
+
+			for _, large := range []bool{false, true} {
+				stbl := findBox(t, track.moov(mdatStart, large), "moov", "trak", "mdia", "minf", "stbl")
+
+				if got := u32s(findBox(t, stbl, "stts")); !equalU32s(got, tt.stts) {
+					t.Errorf("stts %v, want %v", got, tt.stts)
+				}
+				if tt.stss == nil {
+					if hasBox(t, stbl, "stss") {
+						t.Error("stss written, but every sample is a keyframe")
+					}
+				} else if got := u32s(findBox(t, stbl, "stss")); !equalU32s(got, tt.stss) {
+					t.Errorf("stss %v, want %v", got, tt.stss)
+				}
+				if got := u32s(findBox(t, stbl, "stsc")); !equalU32s(got, tt.stsc) {
+					t.Errorf("stsc %v, want %v", got, tt.stsc)
+				}
+
+				stsz := u32s(findBox(t, stbl, "stsz"))
+				if stsz[0] != 0 || int(stsz[1]) != len(tt.samples) {
+					t.Fatalf("stsz sample_size %d, sample_count %d", stsz[0], stsz[1])
+				}
+				for i, s := range tt.samples {
+					if stsz[2+i] != s.Size {
+						t.Errorf("stsz sample %d: %d, want %d", i, stsz[2+i], s.Size)
+					}
+				}
+
+				var got []uint64
+				if large {
+					if hasBox(t, stbl, "stco") {
+						t.Error("stco written in a large file")
+					}
+					co64 := findBox(t, stbl, "co64")
+					for i := 8; i+8 <= len(co64); i += 8 {
+						got = append(got, binary.BigEndian.Uint64(co64[i:]))
+					}
+				} else {
+					stco := u32s(findBox(t, stbl, "stco"))
+					for _, o := range stco[1:] {
+						got = append(got, uint64(o))
+					}
+				}
+				if len(got) != len(offsets) {
+					t.Fatalf("large=%v: %d chunk offsets, want %d", large, len(got), len(offsets))
+				}
+				for i := range got {
+					if got[i] != offsets[i] {
+						t.Errorf("large=%v: chunk %d at %d, want %d", large, i, got[i], offsets[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func equalU32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestWriteMP4Header writes a whole faststart file and checks the sample
+// table points at the samples that follow the header
+func TestWriteMP4Header(t *testing.T) {
+	samples := testSamples(65)
+	track := &mp4Track{SPS: testSPSBaseline, PPS: testPPSCAVLC, Width: 640, Height: 480,
+		Created: time.Unix(1700000000, 0), Samples: samples}
+
+	var file bytes.Buffer
+	if err := writeMP4Header(&file, track); err != nil {
+		t.Fatal(err)
+	}
+	headerSize := file.Len()
+	for i, s := range samples {
+		file.Write(bytes.Repeat([]byte{byte(i)}, int(s.Size)))
+	}
+	data := file.Bytes()
+
+	boxes := splitBoxes(t, data)
+	if len(boxes) != 3 || boxes[0].typ != "ftyp" || boxes[1].typ != "moov" || boxes[2].typ != "mdat" {
+		t.Fatalf("top-level boxes %v, want ftyp, moov, mdat", boxes)
+	}
+
+	stbl := findBox(t, data, "moov", "trak", "mdia", "minf", "stbl")
+	stco := u32s(findBox(t, stbl, "stco"))
+	offset := headerSize
+	for chunk, first := range []int{0, 30, 60} {
+		if int(stco[1+chunk]) != offset {
+			t.Errorf("chunk %d at %d, want %d", chunk, stco[1+chunk], offset)
+		}
+		if data[offset] != byte(first) {
+			t.Errorf("chunk %d starts with sample %d, want %d", chunk, data[offset], first)
+		}
+		for _, s := range samples[first:min(first+30, len(samples))] {
+			offset += int(s.Size)
+		}
+	}
+
+	// 40 samples of 3000 ticks and 25 of 3003 at 90kHz
+	mvhd := u32s(findBox(t, data, "moov", "mvhd"))
+	if created := mvhd[0]; created != 1700000000+mp4EpochOffset {
+		t.Errorf("mvhd creation time %d", created)
+	}
+	if timescale, duration := mvhd[2], mvhd[3]; timescale != 1000 || duration != 2167 {
+		t.Errorf("mvhd duration %d/%d, want 2167/1000", duration, timescale)
+	}
+	if mdhd := u32s(findBox(t, data, "moov", "trak", "mdia", "mdhd")); mdhd[2] != 90000 || mdhd[3] != 195075 {
+		t.Errorf("mdhd duration %d/%d, want 195075/90000", mdhd[3], mdhd[2])
+	}
+
+	if err := writeMP4Header(&bytes.Buffer{}, &mp4Track{SPS: testSPSBaseline, PPS: testPPSCAVLC}); err == nil {
+		t.Error("wrote a header without samples")
+	}
+}
+
+func TestWriteMP4Init(t *testing.T) {
+	track := &mp4Track{SPS: testSPSHigh1080, PPS: testPPSCABAC, Width: 1920, Height: 1080, Samples: testSamples(5)}
+	var buf bytes.Buffer
+	n, err := writeMP4Init(&buf, track)
+	if err != nil || n != buf.Len() {
+		t.Fatalf("writeMP4Init = %d, %v; wrote %d", n, err, buf.Len())
+	}
+	data := buf.Bytes()
+
+	boxes := splitBoxes(t, data)
+	if len(boxes) != 2 || boxes[0].typ != "ftyp" || boxes[1].typ != "moov" {
+		t.Fatalf("top-level boxes %v, want ftyp, moov", boxes)
+	}
+	if trex := u32s(findBox(t, data, "moov", "mvex", "trex")); trex[0] != 1 || trex[1] != 1 {
+		t.Errorf("trex track %d, sample description %d", trex[0], trex[1])
+	}
+	// The samples follow in fragments, so the sample table is empty
+	stbl := findBox(t, data, "moov", "trak", "mdia", "minf", "stbl")
+	if stts := u32s(findBox(t, stbl, "stts")); !equalU32s(stts, []uint32{0}) {
+		t.Errorf("stts %v, want no entries", stts)
+	}
+	if stsz := u32s(findBox(t, stbl, "stsz")); !equalU32s(stsz, []uint32{0, 0}) {
+		t.Errorf("stsz %v, want no samples", stsz)
+	}
+	if len(track.Samples) != 5 {
+		t.Error("writeMP4Init changed the track's samples")
+	}
+}
+
+func TestMP4Fragment(t *testing.T) {
+	samples := []mp4Sample{
+		{Size: 1000, Duration: 3000, Keyframe: true},
+		{Size: 200, Duration: 3003},
+		{Size: 300, Duration: 2997},
+	}
+	const seq, baseTime = 7, 1 << 33 // tfdt needs 64 bits
+
+	fragment := mp4Fragment(seq, baseTime, samples)
+	mdatHeader := fragment[len(fragment)-8:]
+	if size, typ := binary.BigEndian.Uint32(mdatHeader), string(mdatHeader[4:]); size != 8+1500 || typ != "mdat" {
+		t.Fatalf("mdat header %d %s, want %d mdat", size, typ, 8+1500)
+	}
+	moof := fragment[:len(fragment)-8]
+	if boxes := splitBoxes(t, moof); len(boxes) != 1 || boxes[0].typ != "moof" {
+		t.Fatalf("fragment boxes %v, want moof then the mdat header", boxes)
+	}
+
+	if mfhd := u32s(findBox(t, moof, "moof", "mfhd")); mfhd[0] != seq {
+		t.Errorf("mfhd sequence %d, want %d", mfhd[0], seq)
+	}
+	tfhd := findBox(t, moof, "moof", "traf", "tfhd")
+	if flags, track := binary.BigEndian.Uint32(tfhd)&0xffffff, binary.BigEndian.Uint32(tfhd[4:]); flags != 0x020000 || track != 1 {
+		t.Errorf("tfhd flags %06x, track %d", flags, track)
+	}
+	tfdt := findBox(t, moof, "moof", "traf", "tfdt")
+	if version, decodeTime := tfdt[0], binary.BigEndian.Uint64(tfdt[4:]); version != 1 || decodeTime != baseTime {
+		t.Errorf("tfdt version %d, decode time %d", version, decodeTime)
+	}
+
+	trun := findBox(t, moof, "moof", "traf", "trun")
+	if flags := binary.BigEndian.Uint32(trun) & 0xffffff; flags != 0x000701 {
+		t.Errorf("trun flags %06x", flags)
+	}
+	fields := u32s(trun)
+	// The data offset is relative to the moof and lands on the first sample
+	if count, dataOffset := fields[0], fields[1]; count != 3 || int(dataOffset) != len(fragment) {
+		t.Errorf("trun sample count %d, data offset %d, want 3, %d", count, dataOffset, len(fragment))
+	}
+	want := []uint32{
+		3000, 1000, 0x02000000,
+		3003, 200, 0x01010000,
+		2997, 300, 0x01010000,
+	}
+	if got := fields[2:]; !equalU32s(got, want) {
+		t.Errorf("trun samples %v, want %v", got, want)
+	}
+}
+
+func TestMP4BoxHeader(t *testing.T) {
+	if got, want := mp4BoxHeader("mdat", 100), []byte{0, 0, 0, 108, 'm', 'd', 'a', 't'}; !bytes.Equal(got, want) {
+		t.Errorf("small header % x, want % x", got, want)
+	}
+	// Beyond 4GB the size moves to a 64-bit largesize field
+	got := mp4BoxHeader("mdat", 1<<32)
+	want := []byte{0, 0, 0, 1, 'm', 'd', 'a', 't', 0, 0, 0, 1, 0, 0, 0, 16}
+	if !bytes.Equal(got, want) {
+		t.Errorf("large header % x, want % x", got, want)
+	}
+}
+
+func TestAppendAVCC(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{
+			name: "4-byte start codes",
+			in:   []byte{0, 0, 0, 1, 0x67, 0xaa, 0, 0, 0, 1, 0x68, 0xbb, 0xcc},
+			want: []byte{0, 0, 0, 2, 0x67, 0xaa, 0, 0, 0, 3, 0x68, 0xbb, 0xcc},
+		},
+		{
+			name: "3-byte start codes",
+			in:   []byte{0, 0, 1, 0x65, 0x88, 0x84, 0, 0, 1, 0x65, 0x11},
+			want: []byte{0, 0, 0, 3, 0x65, 0x88, 0x84, 0, 0, 0, 2, 0x65, 0x11},
+		},
+		{
+			name: "trailing zeros",
+			in:   []byte{0, 0, 0, 1, 0x41, 0x9a, 0, 0},
+			want: []byte{0, 0, 0, 2, 0x41, 0x9a},
+		},
+		{
+			name: "emulation prevention kept",
+			in:   []byte{0, 0, 0, 1, 0x41, 0, 0, 3, 1},
+			want: []byte{0, 0, 0, 5, 0x41, 0, 0, 3, 1},
+		},
+		{
+			name: "no start code",
+			in:   []byte{0x41, 0x9a},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := appendAVCC(nil, tt.in); !bytes.Equal(got, tt.want) {
+				t.Errorf("appendAVCC = % x, want % x", got, tt.want)
+			}
+			if got := avccSize(tt.in); got != len(tt.want) {
+				t.Errorf("avccSize = %d, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
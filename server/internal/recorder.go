@@ -1,93 +1,155 @@
 package internal
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"webrtc-ipcam/config"
 )
 
 const writeBufferSize = 64 * 1024 // 64KB buffer to batch writes and reduce syscalls
 
-// RecorderManager handles H264 recording (writes .h264, converts to MP4 afterward)
+const (
+	// Continuous recording keeps each day's segments in a directory named like this
+	segmentDirLayout = "2006-01-02"
+	// A longer pause between frames means the stream was interrupted; the
+	// segment is cut there rather than showing its last frame across the gap
+	segmentMaxFrameGap = 2 * time.Second
+)
+
+// RecorderManager handles H264 recording (writes fragmented MP4 while recording,
+// rewrites it with the moov first afterward). Recordings are started and
+// stopped on request, or in continuous mode follow each other around the clock
+// in fixed-length segments.
 type RecorderManager struct {
 	mu             sync.RWMutex
 	recording      atomic.Bool
-	finalizing     atomic.Bool // Set during MP4 conversion
-	file           *os.File
-	writer         *bufio.Writer // Buffered writer to reduce syscalls
-	tempH264Path   string        // Path to raw .h264 file during recording
-	finalH264Path  string        // Path after rename when recording complete
-	filePath       string        // Path to final .mp4 file
+	writer         recordingWriter // Writes the current recording
+	filePath       string          // Path of the current recording
+	recordingID    uint64          // Incremented for every recording started
 	skipConversion bool
+	transcode      bool // Re-encode with ffmpeg instead of muxing the stream as it is
 
 	startTime     time.Time
+	startedBy     string // Who started the current recording
 	bytesWritten  int64
 	framesWritten int64
-	recordingDir  string
-	naluChan      chan []byte
-	done          chan struct{}
-	wg            sync.WaitGroup
+
+	// Capture times of the first and last written frames, on the camera clock
+	firstFrameTime time.Time
+	lastFrameTime  time.Time
+	recordingDir   string
+	frameChan      chan *Frame
+	done           chan struct{}
+	wg             sync.WaitGroup
+
+	// Background conversion of finished recordings (see recording_jobs.go)
+	jobs       []*FinalizeJob
+	nextJobID  int
+	jobWake    chan struct{}
+	jobCtx     context.Context // Cancelled on shutdown
+	cancelJobs context.CancelFunc
 
 	// Cached keyframes for starting recordings
 	lastSPS       []byte
 	lastPPS       []byte
 	waitingForIDR bool // Flag to wait for keyframe before writing
 
-	maxDuration time.Duration   // Maximum recording duration
-	stopTimer   *time.Timer     // Timer to auto-stop recording at max duration
+	maxDuration time.Duration  // Maximum recording duration
+	stopTimer   *time.Timer    // Timer to auto-stop recording at max duration
+	preroll     *prerollBuffer // Recent GOPs a manual recording starts with (nil when disabled)
+	prerollMu   sync.Mutex     // Guards preroll, so frames are buffered while idle without taking mu
+
+	// Continuous recording (recording_mode = continuous)
+	continuous      bool
+	segmentDuration time.Duration
+	segmentEnd      time.Time // The current segment is cut at the first keyframe from then on
+	segmentSPS      []byte    // Parameter sets the current recording started with
+	segmentPPS      []byte
+	segmentFailed   bool // Starting a segment failed; logged once until one starts again
 }
 
 // RecordingStatus represents the current recording state
 type RecordingStatus struct {
-	Available         bool   `json:"available"`
-	Recording         bool   `json:"recording"`
-	Finalizing        bool   `json:"finalizing"`                  // True during MP4 conversion
-	UnavailableReason string `json:"unavailableReason,omitempty"` // Reason why recording is unavailable
-	FilePath          string `json:"filePath,omitempty"`
-	StartTime         int64  `json:"startTime,omitempty"`
-	DurationMs        int64  `json:"durationMs,omitempty"`
-	MaxDurationMs     int64  `json:"maxDurationMs"`               // Max recording duration in ms
-	BytesWritten      int64  `json:"bytesWritten,omitempty"`
-	FramesWritten     int64  `json:"framesWritten,omitempty"`
+	Available         bool          `json:"available"`
+	Recording         bool          `json:"recording"`
+	Mode              string        `json:"mode,omitempty"`              // "manual" or "continuous"
+	Finalizing        bool          `json:"finalizing"`                  // True while earlier recordings are queued for or in MP4 conversion
+	Jobs              []FinalizeJob `json:"jobs,omitempty"`              // Those conversions
+	UnavailableReason string        `json:"unavailableReason,omitempty"` // Reason why recording is unavailable
+	FilePath          string        `json:"filePath,omitempty"`
+	StartTime         int64         `json:"startTime,omitempty"`
+	DurationMs        int64         `json:"durationMs,omitempty"`
+	MaxDurationMs     int64         `json:"maxDurationMs"`       // Max recording duration in ms (manual mode)
+	SegmentMs         int64         `json:"segmentMs,omitempty"` // Segment length in continuous mode
+	BytesWritten      int64         `json:"bytesWritten,omitempty"`
+	FramesWritten     int64         `json:"framesWritten,omitempty"`
+	StartedBy         string        `json:"startedBy,omitempty"`
 }
 
 // RecordingFile represents a recording file for listing
 type RecordingFile struct {
-	Filename   string `json:"filename"`
+	Filename   string `json:"filename"` // Segments of continuous recording are prefixed with their day's directory
 	SizeBytes  int64  `json:"sizeBytes"`
 	CreatedAt  int64  `json:"createdAt"`
 	DurationMs int64  `json:"durationMs"`
+	StartedBy  string `json:"startedBy,omitempty"`
+	Recording  bool   `json:"recording,omitempty"` // Still being written; the download ends at the last complete fragment
 }
 
 // RecordingMeta is metadata stored alongside each recording
 type RecordingMeta struct {
-	DurationMs int64 `json:"durationMs"`
-	SizeBytes  int64 `json:"sizeBytes"`
+	DurationMs int64  `json:"durationMs"`
+	SizeBytes  int64  `json:"sizeBytes"`
+	StartedBy  string `json:"startedBy,omitempty"` // Identity that started the recording
 }
 
-// NewRecorderManager creates a new recorder instance
-func NewRecorderManager(recordingDir string, skipConversion bool, maxMinutes int) *RecorderManager {
-	return &RecorderManager{
-		recordingDir:   recordingDir,
-		skipConversion: skipConversion,
-		maxDuration:    time.Duration(maxMinutes) * time.Minute,
-		naluChan:       make(chan []byte, 500), // Buffer for burst tolerance
+// NewRecorderManager creates a new recorder instance for conf.RecordingDir
+func NewRecorderManager(conf *config.ServerConfig) *RecorderManager {
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	rm := &RecorderManager{
+		recordingDir:   conf.RecordingDir,
+		skipConversion: conf.RecordingSkipConversion,
+		transcode:      conf.RecordingTranscode,
+		frameChan:      make(chan *Frame, 150), // Buffer for burst tolerance
 		done:           make(chan struct{}),
+		jobWake:        make(chan struct{}, 1),
+		jobCtx:         jobCtx,
+		cancelJobs:     cancelJobs,
+	}
+	if conf.RecordingMode == "continuous" {
+		rm.continuous = true
+		rm.segmentDuration = time.Duration(conf.RecordingSegmentMinutes) * time.Minute
+	} else {
+		rm.maxDuration = time.Duration(conf.RecordingMaxMinutes) * time.Minute
+		if conf.RecordingPrerollSeconds > 0 {
+			rm.preroll = newPrerollBuffer(time.Duration(conf.RecordingPrerollSeconds)*time.Second, conf.RecordingPrerollMaxMB*1024*1024)
+		}
 	}
+	return rm
 }
 
-// Start begins recording to a new .h264 file (converts to MP4 on stop)
-func (rm *RecorderManager) Start() (*RecordingStatus, error) {
+// Start begins recording to a new fragmented MP4 (a raw .h264 with
+// recording_skip_conversion). startedBy names the caller and is kept in the
+// recording's metadata. The recording begins with the pre-roll history, from
+// its oldest keyframe, or with no history at the next keyframe.
+func (rm *RecorderManager) Start(startedBy string) (*RecordingStatus, error) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
+	if rm.continuous {
+		return nil, fmt.Errorf("continuous recording is always on")
+	}
 	if rm.recording.Load() {
 		return nil, fmt.Errorf("recording already in progress")
 	}
@@ -97,144 +159,226 @@ func (rm *RecorderManager) Start() (*RecordingStatus, error) {
 		return nil, fmt.Errorf("cannot start recording: SPS/PPS not yet available (wait for camera stream to initialize)")
 	}
 
-	// Generate filenames with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	h264FinalFilename := fmt.Sprintf("recording_%s.h264", timestamp)
-	h264TemporaryFilename := fmt.Sprintf("%s.tmp", h264FinalFilename)
-	rm.finalH264Path = filepath.Join(rm.recordingDir, h264FinalFilename)
-	rm.tempH264Path = filepath.Join(rm.recordingDir, h264TemporaryFilename)
-	rm.filePath = filepath.Join(rm.recordingDir, fmt.Sprintf("recording_%s.mp4", timestamp))
-
-	// Create .h264 file for raw recording
-	file, err := os.Create(rm.tempH264Path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create file: %w", err)
+	// The history is taken and the recording flag set under prerollMu, which
+	// handleFrame checks the flag under too: a frame is either in the history
+	// or written by handleFrame once this returns, never both
+	rm.prerollMu.Lock()
+	if err := rm.startLocked(time.Now(), startedBy, rm.recordingDir); err != nil {
+		rm.prerollMu.Unlock()
+		return nil, err
+	}
+	var frames []*Frame
+	if rm.preroll != nil {
+		frames = rm.preroll.frames()
 	}
+	rm.prerollMu.Unlock()
 
-	rm.file = file
-	rm.writer = bufio.NewWriterSize(file, writeBufferSize)
-	rm.startTime = time.Now()
-	rm.bytesWritten = 0
-	rm.framesWritten = 0
+	// Write the pre-roll, or set flag to wait for next IDR frame before writing any data
+	var preroll time.Duration
+	for _, frame := range frames {
+		rm.writeFrameLocked(frame)
+	}
+	if len(frames) > 0 {
+		preroll = time.Since(frames[0].Timestamp)
+	}
+	rm.waitingForIDR = rm.framesWritten == 0
 
-	// Write cached SPS/PPS first (required for decodable stream)
-	n, _ := rm.writer.Write(rm.lastSPS)
-	rm.bytesWritten += int64(n)
-	n, _ = rm.writer.Write(rm.lastPPS)
-	rm.bytesWritten += int64(n)
+	// Start auto-stop timer
+	id := rm.recordingID
+	rm.stopTimer = time.AfterFunc(rm.maxDuration, func() { rm.autoStop(id) })
 
-	// Set flag to wait for next IDR frame before writing any more data
-	rm.waitingForIDR = true
-	rm.recording.Store(true)
+	if rm.waitingForIDR {
+		log.Printf("Recording started (%s), max duration %v, waiting for keyframe...", rm.relativeName(rm.filePath), rm.maxDuration)
+	} else {
+		log.Printf("Recording started (%s), max duration %v, with %v of pre-roll", rm.relativeName(rm.filePath), rm.maxDuration, preroll.Round(100*time.Millisecond))
+	}
+	return rm.getStatusLocked(), nil
+}
 
-	// Start auto-stop timer
-	rm.stopTimer = time.AfterFunc(rm.maxDuration, func() {
-		log.Printf("Recording reached max duration (%v), auto-stopping...", rm.maxDuration)
-		if _, err := rm.Stop(); err != nil {
-			log.Printf("Failed to auto-stop recording: %v", err)
+// startLocked opens a new recording started at t, in dir
+func (rm *RecorderManager) startLocked(t time.Time, startedBy, dir string) error {
+	var writer recordingWriter
+	var headerSize int
+	var path string
+	var err error
+	if rm.skipConversion {
+		if path, err = newRecordingPath(dir, t, ".h264"); err == nil {
+			writer, headerSize, err = newRawH264Writer(path, rm.lastSPS, rm.lastPPS)
+		}
+	} else {
+		if path, err = newRecordingPath(dir, t, ".mp4"); err == nil {
+			writer, headerSize, err = newFMP4Writer(path, rm.lastSPS, rm.lastPPS, t)
 		}
-	})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
 
-	log.Printf("Recording started (.h264), max duration %v, waiting for keyframe...", rm.maxDuration)
-	return rm.getStatusLocked(), nil
+	rm.writer = writer
+	rm.filePath = path
+	rm.recordingID++
+	rm.startTime = t
+	rm.startedBy = startedBy
+	rm.bytesWritten = int64(headerSize)
+	rm.framesWritten = 0
+	rm.firstFrameTime = time.Time{}
+	rm.lastFrameTime = time.Time{}
+	rm.segmentSPS = rm.lastSPS
+	rm.segmentPPS = rm.lastPPS
+	rm.recording.Store(true)
+	return nil
 }
 
-// Stop ends the current recording, converts .h264 to MP4, and cleans up
-// Mutex is held during entire operation including MP4 conversion to prevent parallel recordings
+// Stop ends the current recording. The fragmented MP4 is complete and playable
+// at once; rewriting it with the moov first (or re-encoding it with
+// recording_transcode) is queued as a background job, so Stop returns without
+// waiting and a new recording can start meanwhile.
 func (rm *RecorderManager) Stop() (*RecordingStatus, error) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
+	if rm.continuous {
+		return nil, fmt.Errorf("continuous recording cannot be stopped")
+	}
 	if !rm.recording.Load() {
 		return nil, fmt.Errorf("no recording in progress")
 	}
 
-	if rm.finalizing.Load() {
-		return nil, fmt.Errorf("recording is already finalizing")
-	}
-
-	rm.recording.Store(false)
-
 	// Cancel auto-stop timer if running
 	if rm.stopTimer != nil {
 		rm.stopTimer.Stop()
 		rm.stopTimer = nil
 	}
 
-	status := rm.getStatusLocked()
+	return rm.finishLocked(time.Time{}), nil
+}
 
-	// Flush and close .h264 file
-	if rm.writer != nil {
-		rm.writer.Flush()
-		rm.writer = nil
-	}
-	if rm.file != nil {
-		rm.file.Sync()
-		rm.file.Close()
-		rm.file = nil
+// autoStop stops recording id once it reaches the max duration. The timer may
+// fire just as the recording is stopped by hand and wait for the lock, so by
+// then a later recording may be current; that one is left running.
+func (rm *RecorderManager) autoStop(id uint64) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if !rm.recording.Load() || rm.recordingID != id {
+		return
 	}
+	log.Printf("Recording reached max duration (%v), auto-stopping...", rm.maxDuration)
+	rm.stopTimer = nil
+	rm.finishLocked(time.Time{})
+}
 
-	// Set finalizing state (mutex still held, prevents new recordings)
-	rm.finalizing.Store(true)
-	defer rm.finalizing.Store(false)
+// finishLocked closes the current recording and queues its conversion. end is
+// the capture time of the frame following the recording (the first frame of
+// the next segment), which its last frame lasts until; when zero, the last
+// frame lasts one average frame interval.
+func (rm *RecorderManager) finishLocked(end time.Time) *RecordingStatus {
+	// Taken while still recording, so the status and metadata describe the finished recording
+	status := rm.getStatusLocked()
+	status.Recording = false
+	if !end.IsZero() && rm.framesWritten > 0 {
+		status.DurationMs = end.Sub(rm.firstFrameTime).Milliseconds()
+	}
+	rm.recording.Store(false)
 
-	// Rename the temp files
-	if err := os.Rename(rm.tempH264Path, rm.finalH264Path); err != nil {
-		return nil, fmt.Errorf("failed to rename file: %w (file %s)", err, rm.tempH264Path)
+	writer, path := rm.writer, rm.filePath
+	rm.writer = nil
+	if err := writer.close(end); err != nil {
+		log.Printf("Warning: failed to close recording %s: %v", rm.relativeName(path), err)
 	}
 
-	log.Printf("Recording stopped: %s (%d bytes, %dms)", filepath.Base(rm.finalH264Path), status.BytesWritten, status.DurationMs)
+	log.Printf("Recording stopped: %s (%d bytes, %dms)", rm.relativeName(path), status.BytesWritten, status.DurationMs)
 
-	// If conversion is skipped, return here
+	// Raw .h264 recordings are not converted
 	if rm.skipConversion {
-		log.Printf("Skipping MP4 conversion...")
-		return status, nil
+		return status
 	}
 
-	// Convert .h264 to MP4 using ffmpeg (blocks while mutex is held)
-	log.Printf("Converting to MP4...")
-	if err := rm.convertToMP4(); err != nil {
-		log.Printf("Warning: MP4 conversion failed: %v (raw .h264 preserved)", err)
-		// Keep the .h264 file if conversion fails
-	} else {
-		// Conversion successful, delete the .h264 file
-		os.Remove(rm.finalH264Path)
-		log.Printf("MP4 finalized: %s", filepath.Base(rm.filePath))
-
-		// Write metadata file
-		meta := RecordingMeta{
-			DurationMs: status.DurationMs,
-			SizeBytes:  status.BytesWritten,
+	writeRecordingMeta(path, status)
+	if fmp4, ok := writer.(*fmp4Writer); ok && len(fmp4.offsets) > 0 {
+		rm.enqueueFinalizeLocked(path, fmp4)
+	}
+	status.Jobs = rm.activeJobsLocked()
+	status.Finalizing = len(status.Jobs) > 0
+	return status
+}
+
+// nextSegmentLocked is called with every keyframe in continuous mode. It
+// starts the first segment, and cuts the current one there once it is due:
+// at the first keyframe past the segment's end on the wall clock, so segments
+// line up with it, or early when the parameter sets change or the stream was
+// interrupted. The keyframe begins the next segment, so there is no gap.
+func (rm *RecorderManager) nextSegmentLocked(frame *Frame) {
+	if rm.lastSPS == nil || rm.lastPPS == nil {
+		return
+	}
+	if rm.recording.Load() {
+		end := frame.Timestamp
+		switch {
+		case rm.framesWritten > 0 && frame.Timestamp.Sub(rm.lastFrameTime) > segmentMaxFrameGap:
+			end = time.Time{}
+		case !frame.Timestamp.Before(rm.segmentEnd):
+		case !bytes.Equal(rm.lastSPS, rm.segmentSPS) || !bytes.Equal(rm.lastPPS, rm.segmentPPS):
+		default:
+			return
 		}
-		metaPath := rm.filePath + ".meta"
-		if metaData, err := json.Marshal(meta); err == nil {
-			os.WriteFile(metaPath, metaData, 0644)
+		rm.finishLocked(end)
+	}
+
+	dir := filepath.Join(rm.recordingDir, frame.Timestamp.Format(segmentDirLayout))
+	if err := rm.startLocked(frame.Timestamp, "", dir); err != nil {
+		// Retried at every keyframe, e.g. until a full disk has room again
+		if !rm.segmentFailed {
+			log.Printf("Failed to start recording segment: %v", err)
+			rm.segmentFailed = true
 		}
+		return
 	}
+	if rm.segmentFailed {
+		log.Printf("Recording segments resumed")
+		rm.segmentFailed = false
+	}
+	rm.segmentEnd = frame.Timestamp.Truncate(rm.segmentDuration).Add(rm.segmentDuration)
+	rm.waitingForIDR = false
+}
 
-	return status, nil
+// newRecordingPath returns a free path in dir for a recording started at t,
+// creating dir if needed. Names carry the start time to the second; a
+// recording started in the same second as the previous one (still
+// converting) gets a suffix.
+func newRecordingPath(dir string, t time.Time, ext string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := "recording_" + t.Format("20060102_150405")
+	path := filepath.Join(dir, name+ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path, nil
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s_%d%s", name, i, ext))
+	}
 }
 
-// convertToMP4 converts the raw .h264 file to MP4 using ffmpeg
-func (rm *RecorderManager) convertToMP4() error {
-	cmd := exec.Command("ffmpeg",
-		"-f", "h264",
-		"-i", rm.finalH264Path,
-		"-c:v", "libx264",
-		"-crf", "23",
-		"-preset", "fast",
-		"-movflags", "+faststart",
-		"-y",
-		rm.filePath,
-	)
-
-	// Capture output for debugging
-	output, err := cmd.CombinedOutput()
+// relativeName returns how a recording is named in the API: its path in the recording directory
+func (rm *RecorderManager) relativeName(path string) string {
+	name, err := filepath.Rel(rm.recordingDir, path)
 	if err != nil {
-		return fmt.Errorf("ffmpeg conversion failed: %w (output: %s)", err, string(output))
+		return filepath.Base(path)
 	}
+	return filepath.ToSlash(name)
+}
 
-	return nil
+// writeRecordingMeta writes the metadata file of a finished recording
+func writeRecordingMeta(path string, status *RecordingStatus) {
+	meta := RecordingMeta{
+		DurationMs: status.DurationMs,
+		SizeBytes:  status.BytesWritten,
+		StartedBy:  status.StartedBy,
+	}
+	if metaData, err := json.Marshal(meta); err == nil {
+		os.WriteFile(path+".meta", metaData, 0644)
+	}
 }
 
 // GetStatus returns current recording status
@@ -248,39 +392,58 @@ func (rm *RecorderManager) getStatusLocked() *RecordingStatus {
 	status := &RecordingStatus{
 		Available:     true,
 		Recording:     rm.recording.Load(),
-		Finalizing:    rm.finalizing.Load(),
+		Mode:          "manual",
+		Jobs:          rm.activeJobsLocked(),
 		MaxDurationMs: rm.maxDuration.Milliseconds(),
 	}
+	if rm.continuous {
+		status.Mode = "continuous"
+		status.SegmentMs = rm.segmentDuration.Milliseconds()
+	}
+	status.Finalizing = len(status.Jobs) > 0
 
 	if status.Recording {
-		status.FilePath = filepath.Base(rm.filePath)
+		status.FilePath = rm.relativeName(rm.filePath)
 		status.StartTime = rm.startTime.UnixMilli()
-		status.DurationMs = time.Since(rm.startTime).Milliseconds()
+		status.DurationMs = rm.mediaDurationLocked().Milliseconds()
 		status.BytesWritten = rm.bytesWritten
 		status.FramesWritten = rm.framesWritten
+		status.StartedBy = rm.startedBy
 	}
 
 	return status
 }
 
-// GetNALUChannel returns the channel for receiving NALUs
-func (rm *RecorderManager) GetNALUChannel() chan<- []byte {
-	return rm.naluChan
+// mediaDurationLocked returns the duration covered by the written frames,
+// measured on the camera capture clock rather than the wall clock.
+func (rm *RecorderManager) mediaDurationLocked() time.Duration {
+	if rm.framesWritten < 2 {
+		return 0
+	}
+	span := rm.lastFrameTime.Sub(rm.firstFrameTime)
+	// The last frame is displayed for one average frame interval
+	return span + span/time.Duration(rm.framesWritten-1)
 }
 
-// ProcessNALUs starts the goroutine that writes NALUs to file
-func (rm *RecorderManager) ProcessNALUs() {
-	rm.wg.Add(1)
+// GetFrameChannel returns the channel for receiving frames
+func (rm *RecorderManager) GetFrameChannel() chan<- *Frame {
+	return rm.frameChan
+}
+
+// ProcessFrames starts the goroutines that write frames to file and convert finished recordings
+func (rm *RecorderManager) ProcessFrames() {
+	rm.wg.Add(2)
+	go rm.runFinalizeJobs()
 	go func() {
 		defer rm.wg.Done()
 
 		for {
 			select {
-			case nalu, ok := <-rm.naluChan:
+			case frame, ok := <-rm.frameChan:
 				if !ok {
 					return
 				}
-				rm.handleNALU(nalu)
+				rm.handleFrame(frame)
 			case <-rm.done:
 				return
 			}
@@ -288,113 +451,177 @@ func (rm *RecorderManager) ProcessNALUs() {
 	}()
 }
 
-func (rm *RecorderManager) handleNALU(nalu []byte) {
-	if len(nalu) < 5 {
-		return // Invalid NALU
+func (rm *RecorderManager) handleFrame(frame *Frame) {
+	// Always cache SPS/PPS for starting future recordings
+	for _, nalu := range frame.NALUs {
+		switch naluType(nalu) {
+		case naluTypeSPS:
+			rm.mu.Lock()
+			rm.resetPrerollLocked(rm.lastSPS, nalu)
+			rm.lastSPS = make([]byte, len(nalu))
+			copy(rm.lastSPS, nalu)
+			rm.mu.Unlock()
+		case naluTypePPS:
+			rm.mu.Lock()
+			rm.resetPrerollLocked(rm.lastPPS, nalu)
+			rm.lastPPS = make([]byte, len(nalu))
+			copy(rm.lastPPS, nalu)
+			rm.mu.Unlock()
+		}
 	}
 
-	naluType := nalu[4] & 0x1F
-
-	// Always cache SPS/PPS for starting future recordings
-	if naluType == 7 { // SPS
-		rm.mu.Lock()
-		rm.lastSPS = make([]byte, len(nalu))
-		copy(rm.lastSPS, nalu)
-		rm.mu.Unlock()
-	} else if naluType == 8 { // PPS
-		rm.mu.Lock()
-		rm.lastPPS = make([]byte, len(nalu))
-		copy(rm.lastPPS, nalu)
-		rm.mu.Unlock()
+	// Keep the frame for pre-roll, and read the recording flag under the same
+	// lock, so Start writes each frame once: either from the history or as it
+	// arrives below
+	recording := rm.recording.Load()
+	if rm.preroll != nil {
+		rm.prerollMu.Lock()
+		rm.preroll.add(frame)
+		recording = rm.recording.Load()
+		rm.prerollMu.Unlock()
 	}
 
 	// If not recording, we're done (just cached SPS/PPS above if needed)
-	if !rm.recording.Load() {
+	if !recording && !(rm.continuous && frame.Keyframe) {
 		return
 	}
 
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
+	if rm.continuous && frame.Keyframe {
+		rm.nextSegmentLocked(frame)
+	}
 	if rm.writer == nil {
 		return
 	}
 
 	// If waiting for IDR frame, only start writing when we get one
 	if rm.waitingForIDR {
-		if naluType == 5 { // IDR frame
+		if frame.Keyframe {
 			rm.waitingForIDR = false
 			log.Printf("Keyframe received, recording video stream...")
 			// Write this IDR frame (fall through to write below)
 		} else {
 			// Skip non-IDR frames until we get a keyframe
-			// This includes any SPS/PPS before the first IDR (we already wrote cached ones)
 			return
 		}
 	}
 
-	// Write the NALU to file
-	n, err := rm.writer.Write(nalu)
+	rm.writeFrameLocked(frame)
+}
+
+// writeFrameLocked writes the whole access unit to the current recording
+func (rm *RecorderManager) writeFrameLocked(frame *Frame) {
+	n, err := rm.writer.writeFrame(frame)
+	rm.bytesWritten += int64(n)
 	if err == nil {
-		rm.bytesWritten += int64(n)
+		if rm.framesWritten == 0 {
+			rm.firstFrameTime = frame.Timestamp
+		}
+		rm.lastFrameTime = frame.Timestamp
 		rm.framesWritten++
 	}
 }
 
-// ListRecordings returns all recording files in the recording directory
+// resetPrerollLocked forgets the pre-roll history when a parameter set changes
+// from old to nalu, since the history could not be decoded with the new one
+func (rm *RecorderManager) resetPrerollLocked(old, nalu []byte) {
+	if rm.preroll != nil && old != nil && !bytes.Equal(old, nalu) {
+		rm.prerollMu.Lock()
+		rm.preroll.reset()
+		rm.prerollMu.Unlock()
+	}
+}
+
+// ListRecordings returns all recording files in the recording directory,
+// including the segments of continuous recording in its per-day directories
 func (rm *RecorderManager) ListRecordings() ([]RecordingFile, error) {
 	entries, err := os.ReadDir(rm.recordingDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read recording directory: %w", err)
 	}
 
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
 	var recordings []RecordingFile
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if !entry.IsDir() {
+			if recording, ok := rm.recordingFileLocked("", entry); ok {
+				recordings = append(recordings, recording)
+			}
 			continue
 		}
-
-		name := entry.Name()
-		// Only include .mp4 files
-		if filepath.Ext(name) != ".mp4" {
+		if _, err := time.Parse(segmentDirLayout, entry.Name()); err != nil {
 			continue
 		}
-
-		info, err := entry.Info()
+		segments, err := os.ReadDir(filepath.Join(rm.recordingDir, entry.Name()))
 		if err != nil {
 			continue
 		}
-
-		recording := RecordingFile{
-			Filename:  name,
-			SizeBytes: info.Size(),
-			CreatedAt: info.ModTime().UnixMilli(),
-		}
-
-		// Try to read duration from metadata file
-		metaPath := filepath.Join(rm.recordingDir, name+".meta")
-		if metaData, err := os.ReadFile(metaPath); err == nil {
-			var meta RecordingMeta
-			if json.Unmarshal(metaData, &meta) == nil {
-				recording.DurationMs = meta.DurationMs
+		for _, segment := range segments {
+			if recording, ok := rm.recordingFileLocked(entry.Name(), segment); ok {
+				recordings = append(recordings, recording)
 			}
 		}
-
-		recordings = append(recordings, recording)
 	}
 
 	return recordings, nil
 }
 
-// GetFilePath returns the full path to a recording file if it exists
+// recordingFileLocked describes entry, in dir of the recording directory, if it is a recording
+func (rm *RecorderManager) recordingFileLocked(dir string, entry os.DirEntry) (RecordingFile, bool) {
+	name := path.Join(dir, entry.Name())
+	// Only include .mp4 files
+	if entry.IsDir() || filepath.Ext(name) != ".mp4" {
+		return RecordingFile{}, false
+	}
+
+	info, err := entry.Info()
+	if err != nil {
+		return RecordingFile{}, false
+	}
+
+	recording := RecordingFile{
+		Filename:  name,
+		SizeBytes: info.Size(),
+		CreatedAt: info.ModTime().UnixMilli(),
+	}
+
+	// Try to read duration from metadata file
+	metaPath := filepath.Join(rm.recordingDir, filepath.FromSlash(name)+".meta")
+	if metaData, err := os.ReadFile(metaPath); err == nil {
+		var meta RecordingMeta
+		if json.Unmarshal(metaData, &meta) == nil {
+			recording.DurationMs = meta.DurationMs
+			recording.StartedBy = meta.StartedBy
+		}
+	}
+	if rm.recording.Load() && name == rm.relativeName(rm.filePath) {
+		recording.Recording = true
+		recording.DurationMs = rm.mediaDurationLocked().Milliseconds()
+		recording.StartedBy = rm.startedBy
+	}
+	return recording, true
+}
+
+// GetFilePath returns the full path to a recording file if it exists. Names
+// are as listed by ListRecordings: a file in the recording directory, or in
+// one of its per-day directories ("2026-01-31/recording_20260131_143000.mp4").
 func (rm *RecorderManager) GetFilePath(filename string) (string, error) {
-	// Sanitize filename to prevent directory traversal
-	filename = filepath.Base(filename)
-	if filepath.Ext(filename) != ".mp4" {
+	// Nothing else is accepted, which rules out directory traversal
+	dir, name := path.Split(filename)
+	if dir != "" {
+		if _, err := time.Parse(segmentDirLayout, strings.TrimSuffix(dir, "/")); err != nil {
+			return "", fmt.Errorf("invalid file path")
+		}
+	}
+	if filepath.Ext(name) != ".mp4" {
 		return "", fmt.Errorf("invalid file type")
 	}
 
-	fullPath := filepath.Join(rm.recordingDir, filename)
+	fullPath := filepath.Join(rm.recordingDir, filepath.FromSlash(filename))
 
 	// Check if file exists
 	if _, err := os.Stat(fullPath); err != nil {
@@ -404,9 +631,50 @@ func (rm *RecorderManager) GetFilePath(filename string) (string, error) {
 	return fullPath, nil
 }
 
+// liveSize returns how much of the recording in progress at filePath can be
+// read: up to the end of its last complete fragment. ok is false when no
+// recording is being written there.
+func (rm *RecorderManager) liveSize(filePath string) (size int64, ok bool) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if !rm.recording.Load() || filePath != rm.filePath {
+		return 0, false
+	}
+	fmp4, ok := rm.writer.(*fmp4Writer)
+	if !ok {
+		return 0, false
+	}
+	return fmp4.complete, true
+}
+
+// DeleteRecording removes a finished recording and its metadata
+func (rm *RecorderManager) DeleteRecording(filename string) error {
+	filePath, err := rm.GetFilePath(filename)
+	if err != nil {
+		return err
+	}
+	rm.mu.RLock()
+	busy := (rm.recording.Load() && filePath == rm.filePath) || rm.finalizingLocked(filePath)
+	rm.mu.RUnlock()
+	if busy {
+		return fmt.Errorf("recording is still in progress")
+	}
+	if err := os.Remove(filePath); err != nil {
+		return fmt.Errorf("failed to delete recording: %w", err)
+	}
+	os.Remove(filePath + ".meta")
+	// A day's directory goes with its last segment (removing a non-empty one fails)
+	if dir := filepath.Dir(filePath); dir != filepath.Clean(rm.recordingDir) {
+		os.Remove(dir)
+	}
+	return nil
+}
+
 // Shutdown gracefully shuts down the recorder
 func (rm *RecorderManager) Shutdown() {
 	close(rm.done)
+	// A conversion in progress is abandoned; its recording stays fragmented
+	rm.cancelJobs()
 	rm.wg.Wait()
 
 	rm.mu.Lock()
@@ -415,22 +683,13 @@ func (rm *RecorderManager) Shutdown() {
 		rm.stopTimer.Stop()
 		rm.stopTimer = nil
 	}
-	// If recording is in progress, flush and close the file
+	// If recording is in progress, write out the last fragment and close the
+	// file. The worker has exited, so it is left fragmented rather than
+	// converted, to shut down quickly.
 	if rm.recording.Load() {
-		rm.recording.Store(false)
-
-		if rm.writer != nil {
-			rm.writer.Flush()
-			rm.writer = nil
-		}
-		if rm.file != nil {
-			rm.file.Sync()
-			rm.file.Close()
-			rm.file = nil
-		}
-		log.Printf("Recording aborted during shutdown: %s", rm.tempH264Path)
+		rm.finishLocked(time.Time{})
 	}
 	rm.mu.Unlock()
 
-	close(rm.naluChan)
+	close(rm.frameChan)
 }
@@ -6,7 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 )
 
@@ -45,14 +45,15 @@ func HandleRecordStart(w http.ResponseWriter, r *http.Request, recorder *Recorde
 		return
 	}
 
-	status, err := recorder.Start()
+	caller := callerName(r)
+	status, err := recorder.Start(caller)
 	if err != nil {
-		log.Printf("Failed to start recording: %v", err)
+		log.Printf("Failed to start recording for %s: %v", caller, err)
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
 
-	log.Printf("Recording started: %s", status.FilePath)
+	log.Printf("Recording started by %s: %s", caller, status.FilePath)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
@@ -77,8 +78,8 @@ func HandleRecordStop(w http.ResponseWriter, r *http.Request, recorder *Recorder
 		return
 	}
 
-	log.Printf("Recording stopped: %s (duration: %dms, size: %d bytes)",
-		status.FilePath, status.DurationMs, status.BytesWritten)
+	log.Printf("Recording stopped by %s: %s (duration: %dms, size: %d bytes)",
+		callerName(r), status.FilePath, status.DurationMs, status.BytesWritten)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
@@ -113,6 +114,28 @@ func HandleRecordList(w http.ResponseWriter, r *http.Request, recorder *Recorder
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleRecordJobs handles GET /record/jobs
+func HandleRecordJobs(w http.ResponseWriter, r *http.Request, recorder *RecorderManager) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if recorder == nil {
+		http.Error(w, "recording not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := struct {
+		Jobs []FinalizeJob `json:"jobs"`
+	}{
+		Jobs: recorder.GetJobs(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // HandleRecordDownload handles GET /record/download/{filename}
 func HandleRecordDownload(w http.ResponseWriter, r *http.Request, recorder *RecorderManager) {
 	if r.Method != http.MethodGet {
@@ -152,7 +175,10 @@ func HandleRecordDownload(w http.ResponseWriter, r *http.Request, recorder *Reco
 	}
 	defer file.Close()
 
-	// Get file info for Content-Length
+	// A recording in progress keeps growing, and its last fragment may be
+	// half written; only the complete fragments are sent
+	live, isLive := recorder.liveSize(filePath)
+
 	stat, err := file.Stat()
 	if err != nil {
 		http.Error(w, "failed to stat file", http.StatusInternalServerError)
@@ -160,10 +186,43 @@ func HandleRecordDownload(w http.ResponseWriter, r *http.Request, recorder *Reco
 	}
 
 	// Use application/octet-stream to prevent browser manipulation
-	// VLC and other players will recognize .h264 extension
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
-	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(filename)+"\"")
+
+	size := stat.Size()
+	if isLive {
+		size = live
+	}
+
+	log.Printf("Recording %s downloaded by %s", filename, callerName(r))
+	// ServeContent also answers range requests, so players can seek
+	http.ServeContent(w, r, filepath.Base(filename), stat.ModTime(), io.NewSectionReader(file, 0, size))
+}
+
+// HandleRecordDelete handles DELETE /record/delete/{filename}
+func HandleRecordDelete(w http.ResponseWriter, r *http.Request, recorder *RecorderManager) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if recorder == nil {
+		http.Error(w, "recording not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	filename := strings.TrimPrefix(r.URL.Path, "/record/delete/")
+	if filename == "" {
+		http.Error(w, "filename required", http.StatusBadRequest)
+		return
+	}
+
+	if err := recorder.DeleteRecording(filename); err != nil {
+		log.Printf("Failed to delete recording %s for %s: %v", filename, callerName(r), err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	io.Copy(w, file)
+	log.Printf("Recording %s deleted by %s", filename, callerName(r))
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"log"
+	"time"
+)
+
+// Finishing a recording (the faststart remux, or the ffmpeg re-encode with
+// recording_transcode) runs as a job on a background worker, one at a time,
+// so Stop returns at once and a new recording can start meanwhile. Until its
+// job is done the recording is a complete fragmented MP4.
+
+// Finalization job states
+const (
+	JobQueued     = "queued"
+	JobConverting = "converting"
+	JobDone       = "done"
+	JobFailed     = "failed"
+)
+
+const finalizeJobHistory = 20 // Finished jobs kept for /record/jobs
+
+// FinalizeJob is the conversion of one finished recording into its final MP4
+type FinalizeJob struct {
+	ID         int    `json:"id"`
+	Filename   string `json:"filename"`
+	State      string `json:"state"`
+	Error      string `json:"error,omitempty"` // Why the job failed; the fragmented MP4 is kept
+	QueuedAt   int64  `json:"queuedAt"`
+	StartedAt  int64  `json:"startedAt,omitempty"`
+	FinishedAt int64  `json:"finishedAt,omitempty"`
+
+	path    string
+	track   *mp4Track // Samples of the fragmented MP4 and where they are, for the remux
+	offsets []int64
+}
+
+// active reports whether the job is still to run or running
+func (j *FinalizeJob) active() bool {
+	return j.State == JobQueued || j.State == JobConverting
+}
+
+// enqueueFinalizeLocked queues the conversion of the fragmented MP4 written by w
+func (rm *RecorderManager) enqueueFinalizeLocked(path string, w *fmp4Writer) *FinalizeJob {
+	rm.nextJobID++
+	job := &FinalizeJob{
+		ID:       rm.nextJobID,
+		Filename: rm.relativeName(path),
+		State:    JobQueued,
+		QueuedAt: time.Now().UnixMilli(),
+		path:     path,
+		track:    w.track,
+		offsets:  w.offsets,
+	}
+	rm.jobs = append(rm.jobs, job)
+
+	select {
+	case rm.jobWake <- struct{}{}:
+	default: // The worker is already due to look at the queue
+	}
+	return job
+}
+
+// trimJobsLocked forgets the oldest finished jobs beyond the history
+func (rm *RecorderManager) trimJobsLocked() {
+	finished := 0
+	for _, j := range rm.jobs {
+		if !j.active() {
+			finished++
+		}
+	}
+	kept := rm.jobs[:0]
+	for _, j := range rm.jobs {
+		if !j.active() && finished > finalizeJobHistory {
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	rm.jobs = kept
+}
+
+// GetJobs returns the queued, running and recently finished jobs, oldest first
+func (rm *RecorderManager) GetJobs() []FinalizeJob {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	jobs := make([]FinalizeJob, len(rm.jobs))
+	for i, j := range rm.jobs {
+		jobs[i] = *j
+	}
+	return jobs
+}
+
+// activeJobsLocked returns the jobs that are queued or running
+func (rm *RecorderManager) activeJobsLocked() []FinalizeJob {
+	var jobs []FinalizeJob
+	for _, j := range rm.jobs {
+		if j.active() {
+			jobs = append(jobs, *j)
+		}
+	}
+	return jobs
+}
+
+// finalizingLocked reports whether a job for path is queued or running
+func (rm *RecorderManager) finalizingLocked(path string) bool {
+	for _, j := range rm.jobs {
+		if j.active() && j.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// runFinalizeJobs is the worker goroutine that runs queued jobs in order
+func (rm *RecorderManager) runFinalizeJobs() {
+	defer rm.wg.Done()
+	for {
+		job := rm.nextFinalizeJob()
+		if job == nil {
+			select {
+			case <-rm.jobWake:
+				continue
+			case <-rm.done:
+				return
+			}
+		}
+
+		var err error
+		if rm.transcode {
+			log.Printf("Converting %s to MP4 with ffmpeg...", job.Filename)
+			err = transcodeToMP4(rm.jobCtx, job.path)
+		} else {
+			err = remuxMP4(rm.jobCtx, job.path, job.track, job.offsets)
+		}
+
+		rm.mu.Lock()
+		job.State = JobDone
+		job.FinishedAt = time.Now().UnixMilli()
+		job.track, job.offsets = nil, nil
+		if err != nil {
+			job.State = JobFailed
+			job.Error = err.Error()
+		}
+		rm.trimJobsLocked()
+		rm.mu.Unlock()
+
+		if err != nil {
+			// The fragmented MP4 is kept; it plays, but seeking needs every fragment read
+			log.Printf("Warning: MP4 conversion of %s failed: %v (fragmented MP4 preserved)", job.Filename, err)
+		} else {
+			log.Printf("MP4 finalized: %s", job.Filename)
+		}
+	}
+}
+
+// nextFinalizeJob marks the oldest queued job as converting and returns it, or nil if there is none
+func (rm *RecorderManager) nextFinalizeJob() *FinalizeJob {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, j := range rm.jobs {
+		if j.State == JobQueued {
+			j.State = JobConverting
+			j.StartedAt = time.Now().UnixMilli()
+			return j
+		}
+	}
+	return nil
+}
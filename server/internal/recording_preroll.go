@@ -0,0 +1,65 @@
+package internal
+
+import "time"
+
+// prerollBuffer keeps the most recent GOPs in memory, so a recording started
+// on request can begin a few seconds before the request instead of at the
+// next keyframe. Only whole GOPs are kept, each starting with its keyframe:
+// frames before the first keyframe cannot be decoded, and a GOP is dropped
+// as a whole when it no longer fits.
+type prerollBuffer struct {
+	duration time.Duration // How far back the oldest kept keyframe should reach
+	maxBytes int           // Cap on the frame data held
+	gops     [][]*Frame
+	size     int
+}
+
+func newPrerollBuffer(duration time.Duration, maxBytes int) *prerollBuffer {
+	return &prerollBuffer{duration: duration, maxBytes: maxBytes}
+}
+
+// add appends frame to the history and forgets the GOPs that are no longer
+// needed: those older than the duration, and the oldest beyond the byte cap
+func (b *prerollBuffer) add(frame *Frame) {
+	if frame.Keyframe {
+		b.gops = append(b.gops, nil)
+	} else if len(b.gops) == 0 {
+		return // Waiting for a keyframe
+	}
+	last := len(b.gops) - 1
+	b.gops[last] = append(b.gops[last], frame)
+	b.size += len(frame.Data)
+
+	// The oldest GOP goes once the next one alone reaches back far enough
+	for len(b.gops) > 1 && frame.Timestamp.Sub(b.gops[1][0].Timestamp) >= b.duration {
+		b.dropOldest()
+	}
+	for b.size > b.maxBytes && len(b.gops) > 0 {
+		// Even the GOP in progress, if it alone is too large; the history
+		// starts again at the next keyframe
+		b.dropOldest()
+	}
+}
+
+func (b *prerollBuffer) dropOldest() {
+	for _, f := range b.gops[0] {
+		b.size -= len(f.Data)
+	}
+	b.gops[0] = nil
+	b.gops = b.gops[1:]
+}
+
+// frames returns the buffered frames, oldest first, starting with a keyframe
+func (b *prerollBuffer) frames() []*Frame {
+	var frames []*Frame
+	for _, gop := range b.gops {
+		frames = append(frames, gop...)
+	}
+	return frames
+}
+
+// reset forgets the history, when it no longer matches the stream (new parameter sets)
+func (b *prerollBuffer) reset() {
+	b.gops = nil
+	b.size = 0
+}
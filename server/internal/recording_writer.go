@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	// A fragment is written at every keyframe, so each GOP reaches the disk as
+	// soon as it is complete. Cameras with very long GOPs are cut more often.
+	fragmentMaxDuration = 4 * time.Second
+	fragmentMaxBytes    = 8 * 1024 * 1024
+
+	// How often written fragments are forced to disk; at most this much is
+	// lost on a power cut
+	recordingSyncInterval = 5 * time.Second
+)
+
+// recordingWriter writes the frames of one recording to disk
+type recordingWriter interface {
+	// writeFrame writes an access unit, returning the bytes it adds to the file
+	writeFrame(frame *Frame) (int, error)
+	// close writes out everything buffered and closes the file. end is the
+	// capture time of the frame that follows the last one written, or zero.
+	close(end time.Time) error
+}
+
+// rawH264Writer writes the Annex-B stream as it is (recording_skip_conversion).
+// The file is named .h264.tmp until the recording is complete.
+type rawH264Writer struct {
+	file      *os.File
+	writer    *bufio.Writer // Buffered writer to reduce syscalls
+	tempPath  string
+	finalPath string
+}
+
+// newRawH264Writer creates path+".tmp" and writes the parameter sets the stream starts with
+func newRawH264Writer(path string, sps, pps []byte) (*rawH264Writer, int, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+	w := &rawH264Writer{
+		file:      file,
+		writer:    bufio.NewWriterSize(file, writeBufferSize),
+		tempPath:  path + ".tmp",
+		finalPath: path,
+	}
+
+	// Write cached SPS/PPS first (required for decodable stream)
+	n, _ := w.writer.Write(sps)
+	m, _ := w.writer.Write(pps)
+	return w, n + m, nil
+}
+
+func (w *rawH264Writer) writeFrame(frame *Frame) (int, error) {
+	return w.writer.Write(frame.Data)
+}
+
+func (w *rawH264Writer) close(end time.Time) error {
+	err := w.writer.Flush()
+	w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if renameErr := os.Rename(w.tempPath, w.finalPath); err == nil {
+		err = renameErr
+	}
+	return err
+}
+
+// fmp4Writer writes a fragmented MP4 while recording: the init segment, then
+// a moof/mdat fragment per GOP. Every complete fragment is playable, so the
+// file can be downloaded while it grows and survives a crash or power cut
+// up to the last fragment on disk.
+type fmp4Writer struct {
+	file  *os.File
+	track *mp4Track // Every sample written so far, for the faststart remux
+	// File offset of every sample in track.Samples
+	offsets  []int64
+	size     int64
+	complete int64 // Size up to the end of the last fragment written in full
+
+	// The fragment being collected. A frame's duration is only known once
+	// the next frame arrives, so the last pending frame has none yet.
+	pending      []mp4Sample
+	pendingData  []byte      // Samples in AVCC form
+	pendingTimes []time.Time // Capture times of the pending samples
+	seq          uint32
+	decodeTime   uint64 // Decode time of the first pending sample, in mp4Timescale units
+
+	firstFrameTime time.Time
+	lastSync       time.Time
+}
+
+// newFMP4Writer creates path and writes the init segment for the stream described by sps and pps
+func newFMP4Writer(path string, sps, pps []byte, created time.Time) (*fmp4Writer, int, error) {
+	track, err := newMP4Track(sps, pps, created)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid SPS: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := writeMP4Init(file, track)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, 0, err
+	}
+	return &fmp4Writer{file: file, track: track, size: int64(n), complete: int64(n), lastSync: time.Now()}, n, nil
+}
+
+func (w *fmp4Writer) writeFrame(frame *Frame) (int, error) {
+	if w.firstFrameTime.IsZero() {
+		w.firstFrameTime = frame.Timestamp
+	}
+
+	written := 0
+	if len(w.pending) > 0 {
+		// The previous frame lasts until this one
+		w.pending[len(w.pending)-1].Duration = w.sampleDuration(w.pendingTimes[len(w.pendingTimes)-1], frame.Timestamp)
+
+		if frame.Keyframe || len(w.pendingData) >= fragmentMaxBytes ||
+			frame.Timestamp.Sub(w.pendingTimes[0]) >= fragmentMaxDuration {
+			n, err := w.flush()
+			if err != nil {
+				return 0, err
+			}
+			written = n
+		}
+	}
+
+	start := len(w.pendingData)
+	w.pendingData = appendAVCC(w.pendingData, frame.Data)
+	w.pending = append(w.pending, mp4Sample{Size: uint32(len(w.pendingData) - start), Keyframe: frame.Keyframe})
+	w.pendingTimes = append(w.pendingTimes, frame.Timestamp)
+	return written, nil
+}
+
+// sampleDuration returns the duration of a frame captured at from and followed
+// by one at to. Times are rounded as offsets from the first frame, so rounding
+// errors do not accumulate.
+func (w *fmp4Writer) sampleDuration(from, to time.Time) uint32 {
+	ticks := func(t time.Time) int64 {
+		d := t.Sub(w.firstFrameTime)
+		return (d.Nanoseconds()*mp4Timescale + int64(time.Second)/2) / int64(time.Second)
+	}
+	// Capture times never go backwards, but a sample must last at least one tick
+	return uint32(max(ticks(to)-ticks(from), 1))
+}
+
+// flush writes the pending samples as one fragment, with a single write so a
+// crash leaves at most the last fragment incomplete
+func (w *fmp4Writer) flush() (int, error) {
+	header := mp4Fragment(w.seq+1, w.decodeTime, w.pending)
+	n, err := w.file.Write(append(header, w.pendingData...))
+	w.size += int64(n)
+	if err == nil {
+		w.seq++
+		w.complete = w.size
+		offset := w.size - int64(len(w.pendingData))
+		for _, s := range w.pending {
+			w.offsets = append(w.offsets, offset)
+			offset += int64(s.Size)
+			w.decodeTime += uint64(s.Duration)
+		}
+		w.track.Samples = append(w.track.Samples, w.pending...)
+	}
+	// A fragment that failed to write (disk full) is dropped rather than retried
+	w.pending = w.pending[:0]
+	w.pendingData = w.pendingData[:0]
+	w.pendingTimes = w.pendingTimes[:0]
+	if err != nil {
+		return n, err
+	}
+
+	if time.Since(w.lastSync) >= recordingSyncInterval {
+		w.file.Sync()
+		w.lastSync = time.Now()
+	}
+	return n, nil
+}
+
+func (w *fmp4Writer) close(end time.Time) error {
+	var err error
+	if len(w.pending) > 0 {
+		last := len(w.pending) - 1
+		if !end.IsZero() {
+			// The last frame is shown until the next recording takes over
+			w.pending[last].Duration = w.sampleDuration(w.pendingTimes[last], end)
+		} else {
+			// The last frame is shown for one average frame interval
+			samples := len(w.track.Samples) + last
+			elapsed := w.decodeTime
+			for _, s := range w.pending[:last] {
+				elapsed += uint64(s.Duration)
+			}
+			w.pending[last].Duration = mp4Timescale / 30
+			if samples > 0 {
+				w.pending[last].Duration = uint32(max(elapsed/uint64(samples), 1))
+			}
+		}
+		_, err = w.flush()
+	}
+	w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// remuxMP4 rewrites a finished fragmented MP4 as a regular MP4 with the moov
+// first, so players can seek in it without reading every fragment. The
+// samples are copied as they are; the new file is written under a temporary
+// name and renamed over the fragmented one. Cancelling ctx abandons it.
+func remuxMP4(ctx context.Context, path string, track *mp4Track, offsets []int64) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := path + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	err = writeRemuxedMP4(ctx, out, in, track, offsets)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func writeRemuxedMP4(ctx context.Context, out *os.File, in io.ReaderAt, track *mp4Track, offsets []int64) error {
+	w := bufio.NewWriterSize(out, writeBufferSize)
+	if err := writeMP4Header(w, track); err != nil {
+		return err
+	}
+
+	// Samples of one fragment are contiguous, so runs are copied in one go
+	for i := 0; i < len(offsets); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start, end := offsets[i], offsets[i]+int64(track.Samples[i].Size)
+		i++
+		for i < len(offsets) && offsets[i] == end {
+			end += int64(track.Samples[i].Size)
+			i++
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(in, start, end-start)); err != nil {
+			return fmt.Errorf("copying samples at %d: %w", start, err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// transcodeToMP4 re-encodes a finished recording with ffmpeg (recording_transcode),
+// replacing it once ffmpeg succeeds. Cancelling ctx kills ffmpeg.
+func transcodeToMP4(ctx context.Context, path string) error {
+	tmpPath := path + ".tmp"
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-i", path,
+		"-c:v", "libx264",
+		"-crf", "23",
+		"-preset", "fast",
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y",
+		tmpPath,
+	)
+
+	// Capture output for debugging
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg conversion failed: %w (output: %s)", err, string(output))
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,365 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-ipcam/config"
+)
+
+// Share links give a guest time-limited access without an account, scoped to the
+// live view or to downloading one recording. A link carries a token
+//
+//	share:<id>.<HMAC-SHA256 of id>
+//
+// which is accepted wherever a bearer token is (Authorization header,
+// ?access_token= or the web client's ?token=). The token only proves the id was
+// issued by this server; scope, expiry and revocation are looked up by id.
+
+const (
+	sharePrefix     = "share:"
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+// Share scopes
+const (
+	ShareLive      = "live"      // Watch the camera
+	ShareRecording = "recording" // Download one recording
+)
+
+// ShareLink is an issued share link
+type ShareLink struct {
+	ID        string    `json:"id"`
+	Scope     string    `json:"scope"`
+	Filename  string    `json:"filename,omitempty"` // Recording, for the recording scope
+	Label     string    `json:"label,omitempty"`    // Who the link is for, shown in logs
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// name identifies the link's holder in logs
+func (l *ShareLink) name() string {
+	if l.Label != "" {
+		return "share " + l.Label
+	}
+	return "share " + l.ID[:8]
+}
+
+// allows reports whether the link covers the request, for routes accepting its scope
+func (l *ShareLink) allows(scope string, r *http.Request) bool {
+	if l.Scope != scope {
+		return false
+	}
+	if scope == ShareRecording {
+		// The only route accepting this scope is /record/download/{filename}
+		return strings.TrimPrefix(r.URL.Path, "/record/download/") == l.Filename
+	}
+	return true
+}
+
+// ShareLinks issues, verifies and revokes share links. Links are kept in
+// share_links_file when configured, so they survive restarts; otherwise
+// they are lost on restart.
+type ShareLinks struct {
+	path  string
+	onEnd func(id string) // Called when a link is revoked or expires, to disconnect its viewers
+
+	mu     sync.Mutex
+	secret []byte
+	links  map[string]*ShareLink
+	timers map[string]*time.Timer
+}
+
+// shareFile is the on-disk form of ShareLinks
+type shareFile struct {
+	Secret []byte       `json:"secret"`
+	Links  []*ShareLink `json:"links"`
+}
+
+// NewShareLinks loads the links from conf.ShareLinksFile, if set. onEnd is called
+// with the id of every link that is revoked or expires.
+func NewShareLinks(conf *config.ServerConfig, onEnd func(id string)) (*ShareLinks, error) {
+	s := &ShareLinks{
+		path:   conf.ShareLinksFile,
+		onEnd:  onEnd,
+		links:  make(map[string]*ShareLink),
+		timers: make(map[string]*time.Timer),
+	}
+
+	if s.path != "" {
+		data, err := os.ReadFile(s.path)
+		switch {
+		case err == nil:
+			var file shareFile
+			if err := json.Unmarshal(data, &file); err != nil {
+				return nil, fmt.Errorf("share links file %s: %w", s.path, err)
+			}
+			s.secret = file.Secret
+			for _, link := range file.Links {
+				if time.Now().Before(link.ExpiresAt) {
+					s.links[link.ID] = link
+					s.scheduleExpiry(link)
+				}
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("share links file: %w", err)
+		}
+	}
+
+	if len(s.secret) == 0 {
+		s.secret = make([]byte, 32)
+		if _, err := rand.Read(s.secret); err != nil {
+			return nil, fmt.Errorf("share link secret: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// Create issues a link and returns it with its token
+func (s *ShareLinks) Create(scope, filename, label, createdBy string, ttl time.Duration) (*ShareLink, string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	link := &ShareLink{
+		ID:        id,
+		Scope:     scope,
+		Filename:  filename,
+		Label:     label,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[id] = link
+	s.scheduleExpiry(link)
+	if err := s.saveLocked(); err != nil {
+		delete(s.links, id)
+		s.timers[id].Stop()
+		delete(s.timers, id)
+		return nil, "", err
+	}
+	return link, sharePrefix + id + "." + s.sign(id), nil
+}
+
+// Verify returns the active link a token was issued for
+func (s *ShareLinks) Verify(token string) (*ShareLink, error) {
+	id, signature, ok := strings.Cut(strings.TrimPrefix(token, sharePrefix), ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(id))) {
+		return nil, errors.New("invalid share link")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link := s.links[id]
+	if link == nil {
+		return nil, errors.New("share link revoked or expired")
+	}
+	if time.Now().After(link.ExpiresAt) {
+		return nil, errors.New("share link expired")
+	}
+	return link, nil
+}
+
+// List returns the active links, newest first
+func (s *ShareLinks) List() []ShareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	links := make([]ShareLink, 0, len(s.links))
+	for _, link := range s.links {
+		links = append(links, *link)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.After(links[j].CreatedAt) })
+	return links
+}
+
+// Revoke deletes a link and disconnects anyone viewing with it
+func (s *ShareLinks) Revoke(id string) bool {
+	s.mu.Lock()
+	link := s.links[id]
+	if link != nil {
+		s.removeLocked(id)
+	}
+	s.mu.Unlock()
+
+	if link == nil {
+		return false
+	}
+	if s.onEnd != nil {
+		s.onEnd(id)
+	}
+	return true
+}
+
+// scheduleExpiry ends the link at its expiry time. Caller must hold mu.
+func (s *ShareLinks) scheduleExpiry(link *ShareLink) {
+	id := link.ID
+	s.timers[id] = time.AfterFunc(time.Until(link.ExpiresAt), func() {
+		s.mu.Lock()
+		_, active := s.links[id]
+		if active {
+			s.removeLocked(id)
+		}
+		s.mu.Unlock()
+
+		if active {
+			log.Printf("Share link %s expired", link.name())
+			if s.onEnd != nil {
+				s.onEnd(id)
+			}
+		}
+	})
+}
+
+// removeLocked forgets a link and persists the change. Caller must hold mu.
+func (s *ShareLinks) removeLocked(id string) {
+	delete(s.links, id)
+	if timer := s.timers[id]; timer != nil {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Printf("Failed to save share links: %v", err)
+	}
+}
+
+// saveLocked writes the links to the share links file, if any. Caller must hold mu.
+func (s *ShareLinks) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	file := shareFile{Secret: s.secret}
+	for _, link := range s.links {
+		file.Links = append(file.Links, link)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	// Written to a temp file and renamed, so a crash never leaves a truncated file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save share links: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *ShareLinks) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// HandleShares handles GET /share (list active links) and POST /share (create a link).
+// POST takes {"scope":"live"|"recording","filename":"...","hours":24,"label":"..."}.
+func HandleShares(w http.ResponseWriter, r *http.Request, shares *ShareLinks, recorder *RecorderManager) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Links []ShareLink `json:"links"`
+		}{shares.List()})
+
+	case http.MethodPost:
+		var req struct {
+			Scope    string  `json:"scope"`
+			Filename string  `json:"filename"`
+			Hours    float64 `json:"hours"`
+			Label    string  `json:"label"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+
+		ttl := defaultShareTTL
+		if req.Hours != 0 {
+			ttl = time.Duration(req.Hours * float64(time.Hour))
+		}
+		if ttl <= 0 || ttl > maxShareTTL {
+			http.Error(w, fmt.Sprintf("hours must be between 0 and %d", int(maxShareTTL.Hours())), http.StatusBadRequest)
+			return
+		}
+
+		// The download URL is relative to the page the admin opened, which is this server
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		origin := scheme + "://" + r.Host
+
+		var url string
+		switch req.Scope {
+		case ShareLive:
+			req.Filename = ""
+		case ShareRecording:
+			if recorder == nil {
+				http.Error(w, "recording not available", http.StatusServiceUnavailable)
+				return
+			}
+			if _, err := recorder.GetFilePath(req.Filename); err != nil {
+				http.Error(w, "recording not found", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, `scope must be "live" or "recording"`, http.StatusBadRequest)
+			return
+		}
+
+		link, token, err := shares.Create(req.Scope, req.Filename, req.Label, callerName(r), ttl)
+		if err != nil {
+			log.Printf("Failed to create share link: %v", err)
+			http.Error(w, "failed to create share link", http.StatusInternalServerError)
+			return
+		}
+		if req.Scope == ShareLive {
+			url = origin + "/?token=" + token
+		} else {
+			url = origin + "/record/download/" + req.Filename + "?access_token=" + token
+		}
+		log.Printf("Share link %s (%s %s) created by %s, expires %s", link.name(), link.Scope, link.Filename, link.CreatedBy, link.ExpiresAt.Format(time.RFC3339))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			ShareLink
+			Token string `json:"token"`
+			URL   string `json:"url"`
+		}{*link, token, url})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleShareRevoke handles DELETE /share/{id}
+func HandleShareRevoke(w http.ResponseWriter, r *http.Request, shares *ShareLinks) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/share/")
+	if !shares.Revoke(id) {
+		http.Error(w, "share link not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Share link %s revoked by %s", id, callerName(r))
+	w.WriteHeader(http.StatusNoContent)
+}
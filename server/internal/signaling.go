@@ -2,68 +2,214 @@ package internal
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"webrtc-ipcam/config"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
 	"github.com/pion/webrtc/v4"
 )
 
-func SetupMediaEngine() *webrtc.MediaEngine {
-	m := &webrtc.MediaEngine{}
-	m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeH264,
-			ClockRate:   90000,
-			SDPFmtpLine: "profile-level-id=42e01f;level-asymmetry-allowed=1;packetization-mode=1",
+// DefaultProfileLevelID is used when the camera stream parameters are not known
+// (Constrained Baseline, level 3.1).
+const DefaultProfileLevelID = "42e01f"
+
+// H264Codec returns the only codec offered to viewers: H264 with the camera's
+// profile-level-id and packetization-mode 1 (the FU-A/STAP-A framing our payloader emits).
+func H264Codec(profileLevelID string) webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "profile-level-id=" + profileLevelID + ";level-asymmetry-allowed=1;packetization-mode=1",
+		// Lets viewers ask for a keyframe after packet loss
+		RTCPFeedback: []webrtc.RTCPFeedback{
+			{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+			{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
 		},
-		PayloadType: 96,
-	}, webrtc.RTPCodecTypeVideo)
-	_ = m.RegisterDefaultCodecs()
-	return m
+	}
+}
+
+// SetupMediaEngine registers only the given H264 codec, so a browser can never
+// negotiate a profile or packetization mode the camera does not produce.
+func SetupMediaEngine(codec webrtc.RTPCodecCapability) (*webrtc.MediaEngine, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: codec,
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetupInterceptors builds the RTP/RTCP interceptor chain: a NACK responder that
+// retransmits from the last nackBufferSize packets (0 disables NACK) and periodic
+// sender reports, which viewers need to report round-trip time in their receiver reports.
+func SetupInterceptors(m *webrtc.MediaEngine, nackBufferSize int) (*interceptor.Registry, error) {
+	registry := &interceptor.Registry{}
+
+	if nackBufferSize > 0 {
+		responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(nackBufferSize)))
+		if err != nil {
+			return nil, fmt.Errorf("nack responder: %w", err)
+		}
+		// Viewers only send generic NACKs for payload types that advertise them
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBNACK}, webrtc.RTPCodecTypeVideo)
+		registry.Add(responder)
+	}
+
+	sender, err := report.NewSenderInterceptor(report.SenderInterval(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("sender reports: %w", err)
+	}
+	registry.Add(sender)
+
+	return registry, nil
+}
+
+// offerAcceptsCodec reports whether a video section of the offer SDP lists an H264
+// payload type the codec can be sent as: packetization-mode=1 and the same
+// profile_idc and constraint flags (the level may differ, as pion's matcher allows).
+func offerAcceptsCodec(offerSDP string, codec webrtc.RTPCodecCapability) bool {
+	want := fmtpParams(codec.SDPFmtpLine)["profile-level-id"]
+
+	inVideo := false
+	h264PTs := map[string]bool{}
+	fmtps := map[string]string{}
+	for _, line := range strings.Split(offerSDP, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			inVideo = strings.HasPrefix(line, "m=video")
+			continue
+		}
+		if !inVideo {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "a=rtpmap:"); ok {
+			pt, enc, _ := strings.Cut(rest, " ")
+			if strings.HasPrefix(strings.ToUpper(enc), "H264/90000") {
+				h264PTs[pt] = true
+			}
+		} else if rest, ok := strings.CutPrefix(line, "a=fmtp:"); ok {
+			pt, params, _ := strings.Cut(rest, " ")
+			fmtps[pt] = params
+		}
+	}
+
+	for pt := range h264PTs {
+		params := fmtpParams(fmtps[pt])
+		if params["packetization-mode"] != "1" {
+			continue
+		}
+		offered, ok := params["profile-level-id"]
+		if !ok {
+			offered = "42000a" // RFC 6184 default: Baseline, level 1.0
+		}
+		if len(offered) == 6 && len(want) == 6 && strings.EqualFold(offered[:4], want[:4]) {
+			return true
+		}
+	}
+	return false
 }
 
-func HandleOffer(w http.ResponseWriter, r *http.Request, api *webrtc.API, cm *ClientManager, conf *config.ServerConfig) {
+// fmtpParams parses "key=value;key=value" fmtp parameters
+func fmtpParams(line string) map[string]string {
+	params := map[string]string{}
+	for _, kv := range strings.Split(line, ";") {
+		key, val, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		if key != "" {
+			params[strings.ToLower(key)] = val
+		}
+	}
+	return params
+}
+
+func HandleOffer(w http.ResponseWriter, r *http.Request, api *webrtc.API, codec webrtc.RTPCodecCapability, cm *ClientManager, conf *config.ServerConfig) {
 	var offer webrtc.SessionDescription
 	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
 		http.Error(w, "invalid offer", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Received offer SDP:\n%s", offer.SDP)
+	log.Printf("Received offer from %s, SDP:\n%s", callerName(r), offer.SDP)
 
-	peerConn, err := api.NewPeerConnection(webrtc.Configuration{})
-	if err != nil {
-		http.Error(w, "failed to create peer connection", http.StatusInternalServerError)
+	// Refuse viewers that cannot decode the camera's stream instead of sending an unusable track
+	if !offerAcceptsCodec(offer.SDP, codec) {
+		log.Printf("Rejecting offer: no H264 payload compatible with %s", codec.SDPFmtpLine)
+		http.Error(w, "offer does not support H264 "+codec.SDPFmtpLine, http.StatusNotAcceptable)
 		return
 	}
 
-	// Ensure cleanup on error paths
-	var setupComplete bool
-	defer func() {
-		if !setupComplete {
-			peerConn.Close()
-		}
-	}()
-
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
-		"video", "rpi-camera",
-	)
+	peerConn, err := newViewerPeer(api, codec, cm, conf, viewerOptions{viewer: callerName(r), shareID: shareID(r)})
 	if err != nil {
-		http.Error(w, "failed to create track", http.StatusInternalServerError)
+		log.Printf("Failed to set up viewer: %v", err)
+		http.Error(w, "failed to set up peer connection", http.StatusInternalServerError)
 		return
 	}
 
-	if _, err := peerConn.AddTrack(videoTrack); err != nil {
-		log.Printf("Failed to add track: %v", err)
-		http.Error(w, "failed to add track", http.StatusInternalServerError)
+	if err := answerOffer(peerConn, offer); err != nil {
+		log.Printf("Failed to answer offer: %v", err)
+		http.Error(w, "failed to answer offer", http.StatusInternalServerError)
+		peerConn.Close()
 		return
 	}
 
-	// pass framerate so client timestamps increment consistently
-	client := NewClient(peerConn, videoTrack, nil, conf.Framerate)
+	// Wait for ICE candidates (grow timeout to be more tolerant on slow networks)
+	waitForGathering(peerConn, 5*time.Second)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(peerConn.LocalDescription()); err != nil {
+		log.Printf("Failed to encode answer: %v", err)
+	}
+}
+
+// viewerOptions adapts newViewerPeer to a signaling transport
+type viewerOptions struct {
+	viewer           string                          // Authenticated caller, for logs
+	shareID          string                          // Share link the caller used, if any
+	onCandidate      func(*webrtc.ICECandidate)      // Trickle local candidates (nil when gathering completes) instead of only logging them
+	onICEStateChange func(webrtc.ICEConnectionState) // Called after the state is logged
+	onClose          func()                          // Runs once the client has been removed and the connection closed
+	keepOnDisconnect bool                            // Only tear down on Closed, leaving ICE recovery to the signaling channel
+}
+
+// newViewerPeer creates a peer connection that sends the camera track to one viewer
+// and registers it with the ClientManager. The client is removed and the connection
+// closed when it disconnects, fails or is closed, or only when closed with keepOnDisconnect.
+func newViewerPeer(api *webrtc.API, codec webrtc.RTPCodecCapability, cm *ClientManager, conf *config.ServerConfig, opts viewerOptions) (*webrtc.PeerConnection, error) {
+	peerConn, err := api.NewPeerConnection(peerConfiguration(conf))
+	if err != nil {
+		return nil, fmt.Errorf("create peer connection: %w", err)
+	}
+
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(codec, "video", "rpi-camera")
+	if err != nil {
+		peerConn.Close()
+		return nil, fmt.Errorf("create track: %w", err)
+	}
+
+	rtpSender, err := peerConn.AddTrack(videoTrack)
+	if err != nil {
+		peerConn.Close()
+		return nil, fmt.Errorf("add track: %w", err)
+	}
+
+	// RTP timestamps are derived from frame capture times
+	client := NewClient(peerConn, videoTrack, nil)
+	client.shareID = opts.shareID
+
+	// Read RTCP so PLI/FIR from the viewer trigger a keyframe resend. The SSRC is read
+	// here because the sender's parameters change during SetRemoteDescription.
+	var ssrc uint32
+	if encodings := rtpSender.GetParameters().Encodings; len(encodings) > 0 {
+		ssrc = uint32(encodings[0].SSRC)
+	}
+	go client.readRTCP(rtpSender, ssrc)
 
 	// Handle incoming data channel from client
 	peerConn.OnDataChannel(func(dc *webrtc.DataChannel) {
@@ -88,60 +234,66 @@ func HandleOffer(w http.ResponseWriter, r *http.Request, api *webrtc.API, cm *Cl
 	cm.AddClient(client)
 
 	peerConn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Printf("PeerConnection state: %v", state)
-		if state == webrtc.PeerConnectionStateDisconnected ||
-			state == webrtc.PeerConnectionStateFailed ||
-			state == webrtc.PeerConnectionStateClosed {
+		log.Printf("PeerConnection state for %s: %v", opts.viewer, state)
+		if state == webrtc.PeerConnectionStateConnected {
+			client.markConnected()
+		}
+		closed := state == webrtc.PeerConnectionStateClosed
+		if !opts.keepOnDisconnect {
+			closed = closed ||
+				state == webrtc.PeerConnectionStateDisconnected ||
+				state == webrtc.PeerConnectionStateFailed
+		}
+		if closed {
 			cm.RemoveClient(client)
 			peerConn.Close()
+			if opts.onClose != nil {
+				opts.onClose()
+			}
 		}
 	})
 
 	peerConn.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
-			return
+		if c != nil {
+			log.Printf("New ICE candidate: %s", c.String())
+		}
+		if opts.onCandidate != nil {
+			opts.onCandidate(c)
 		}
-		log.Printf("New ICE candidate: %s", c.String())
 	})
 
 	peerConn.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		log.Printf("ICE connection state: %s", state.String())
+		if opts.onICEStateChange != nil {
+			opts.onICEStateChange(state)
+		}
 	})
 
+	return peerConn, nil
+}
+
+// answerOffer applies the viewer's offer and sets the local answer, which starts ICE gathering
+func answerOffer(peerConn *webrtc.PeerConnection, offer webrtc.SessionDescription) error {
 	if err := peerConn.SetRemoteDescription(offer); err != nil {
-		http.Error(w, "failed to set remote description", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("set remote description: %w", err)
 	}
 
 	answer, err := peerConn.CreateAnswer(nil)
 	if err != nil {
-		http.Error(w, "failed to create answer", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("create answer: %w", err)
 	}
 
 	if err := peerConn.SetLocalDescription(answer); err != nil {
-		log.Printf("Failed to set local description: %v", err)
-		http.Error(w, "failed to set local description", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("set local description: %w", err)
 	}
+	return nil
+}
 
-	// Wait for ICE candidates (grow timeout to be more tolerant on slow networks)
-	done := make(chan struct{})
-	peerConn.OnICEGatheringStateChange(func(state webrtc.ICEGatheringState) {
-		if state == webrtc.ICEGatheringStateComplete {
-			close(done)
-		}
-	})
+// waitForGathering blocks until ICE gathering completes or the timeout expires,
+// so the local description carries the candidates found so far
+func waitForGathering(peerConn *webrtc.PeerConnection, timeout time.Duration) {
 	select {
-	case <-done:
-	case <-time.After(5 * time.Second): // increased timeout
-	}
-
-	// Mark setup as complete to prevent cleanup
-	setupComplete = true
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(peerConn.LocalDescription()); err != nil {
-		log.Printf("Failed to encode answer: %v", err)
+	case <-webrtc.GatheringCompletePromise(peerConn):
+	case <-time.After(timeout):
 	}
 }
@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"webrtc-ipcam/config"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// WebSocket signaling with trickle ICE. Unlike /offer, the answer is sent as soon as
+// it is created and candidates follow as they are gathered, in both directions.
+//
+// Client to server:
+//
+//	{"type":"offer","sdp":"..."}          Start streaming, or renegotiate (e.g. ICE restart) on an existing connection
+//	{"type":"answer","sdp":"..."}         Answer to a server offer
+//	{"type":"candidate","candidate":{...}} Remote ICE candidate (RTCIceCandidateInit)
+//	{"type":"close"}                      Hang up
+//
+// Server to client:
+//
+//	{"type":"iceServers","iceServers":[...]} Sent on connect: STUN/TURN servers (with credentials) for the RTCPeerConnection
+//	{"type":"answer","sdp":"..."}
+//	{"type":"offer","sdp":"..."}          ICE restart after the connection failed
+//	{"type":"candidate","candidate":{...}} Local ICE candidate; no candidate field once gathering completes
+//	{"type":"close","reason":"..."}       The session ended; the socket closes right after
+//	{"type":"error","reason":"..."}       The last message was rejected
+
+const (
+	wsWriteTimeout = 5 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingInterval = 20 * time.Second
+	wsMaxMessage   = 64 * 1024
+)
+
+// SignalMessage is a message on the signaling WebSocket
+type SignalMessage struct {
+	Type       string                   `json:"type"`
+	SDP        string                   `json:"sdp,omitempty"`
+	Candidate  *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Reason     string                   `json:"reason,omitempty"`
+	ICEServers []webrtc.ICEServer       `json:"iceServers,omitempty"`
+}
+
+// SignalingHub tracks open signaling sockets so the server can close them all
+type SignalingHub struct {
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	sessions map[*wsSession]struct{}
+}
+
+// NewSignalingHub accepts WebSocket connections from corsOrigin ("*" allows any origin)
+func NewSignalingHub(corsOrigin string) *SignalingHub {
+	return &SignalingHub{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				return corsOrigin == "*" || origin == "" || origin == corsOrigin
+			},
+		},
+		sessions: make(map[*wsSession]struct{}),
+	}
+}
+
+// CloseAll tells every connected client why the server is closing their session, so they can reconnect
+func (h *SignalingHub) CloseAll(reason string) {
+	h.mu.Lock()
+	sessions := make([]*wsSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.close(reason)
+	}
+}
+
+type wsSession struct {
+	conn     *websocket.Conn
+	writeMu  sync.Mutex // gorilla/websocket allows one concurrent writer
+	peerConn *webrtc.PeerConnection
+	closed   chan struct{}
+	once     sync.Once
+
+	negotiateMu sync.Mutex // Serializes answering client offers with offering ICE restarts
+
+	// Local candidates are held while a description is set and sent: pion
+	// gathers as soon as it is set, and the client drops a candidate that
+	// arrives before the description it belongs to
+	candidateMu sync.Mutex
+	holding     bool
+	held        []SignalMessage
+}
+
+// HandleSignalingWS upgrades the request and runs one viewer's signaling session until either side closes
+func HandleSignalingWS(w http.ResponseWriter, r *http.Request, api *webrtc.API, codec webrtc.RTPCodecCapability, cm *ClientManager, conf *config.ServerConfig, turnServer *TURNServer, hub *SignalingHub) {
+	conn, err := hub.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return // Upgrade has already replied
+	}
+	conn.SetReadLimit(wsMaxMessage)
+
+	session := &wsSession{conn: conn, closed: make(chan struct{})}
+	hub.mu.Lock()
+	hub.sessions[session] = struct{}{}
+	hub.mu.Unlock()
+	defer func() {
+		hub.mu.Lock()
+		delete(hub.sessions, session)
+		hub.mu.Unlock()
+	}()
+
+	log.Printf("Signaling WebSocket connected from %s (%s)", r.RemoteAddr, callerName(r))
+	go session.keepAlive()
+	// Sent before any offer, so the client can configure its peer connection with them
+	session.send(SignalMessage{Type: "iceServers", ICEServers: ClientICEServers(r, conf, turnServer)})
+	session.readLoop(api, codec, cm, conf, viewerOptions{viewer: callerName(r), shareID: shareID(r)})
+
+	// The peer connection lives as long as its signaling socket
+	session.close("")
+	if session.peerConn != nil {
+		session.peerConn.Close()
+	}
+	log.Printf("Signaling WebSocket from %s closed", r.RemoteAddr)
+}
+
+// readLoop handles client messages in order, so candidates always follow their offer
+func (s *wsSession) readLoop(api *webrtc.API, codec webrtc.RTPCodecCapability, cm *ClientManager, conf *config.ServerConfig, opts viewerOptions) {
+	s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var msg SignalMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Signaling read error: %v", err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case "offer":
+			s.handleOffer(msg.SDP, api, codec, cm, conf, opts)
+		case "answer":
+			if s.peerConn == nil {
+				s.sendError("no session to answer")
+				continue
+			}
+			if err := s.peerConn.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP}); err != nil {
+				log.Printf("Failed to apply renegotiation answer: %v", err)
+				s.sendError("invalid answer")
+			}
+		case "candidate":
+			if s.peerConn == nil {
+				s.sendError("candidate before offer")
+				continue
+			}
+			if msg.Candidate == nil {
+				continue // End of the client's candidates
+			}
+			if err := s.peerConn.AddICECandidate(*msg.Candidate); err != nil {
+				log.Printf("Failed to add remote candidate: %v", err)
+			}
+		case "close":
+			return
+		default:
+			s.sendError("unknown message type " + msg.Type)
+		}
+	}
+}
+
+// handleOffer answers the first offer by creating the viewer with opts, and later offers by renegotiating
+func (s *wsSession) handleOffer(sdp string, api *webrtc.API, codec webrtc.RTPCodecCapability, cm *ClientManager, conf *config.ServerConfig, opts viewerOptions) {
+	if !offerAcceptsCodec(sdp, codec) {
+		log.Printf("Rejecting WebSocket offer: no H264 payload compatible with %s", codec.SDPFmtpLine)
+		s.close("offer does not support H264 " + codec.SDPFmtpLine)
+		return
+	}
+
+	s.negotiateMu.Lock()
+	defer s.negotiateMu.Unlock()
+	s.holdCandidates()
+
+	if s.peerConn == nil {
+		opts.onCandidate = s.sendCandidate
+		opts.onICEStateChange = s.restartICEOnFailure
+		opts.onClose = func() { s.close("peer connection closed") }
+		opts.keepOnDisconnect = true
+		peerConn, err := newViewerPeer(api, codec, cm, conf, opts)
+		if err != nil {
+			log.Printf("Failed to set up viewer: %v", err)
+			s.dropCandidates()
+			s.close("failed to set up peer connection")
+			return
+		}
+		s.peerConn = peerConn
+	} else if s.peerConn.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		// Both sides offered at once: drop our ICE restart offer in favour of the client's
+		if err := s.peerConn.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			log.Printf("Failed to roll back local offer: %v", err)
+		}
+	}
+
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err := answerOffer(s.peerConn, offer); err != nil {
+		log.Printf("Failed to answer WebSocket offer: %v", err)
+		s.dropCandidates()
+		s.sendError("failed to answer offer")
+		return
+	}
+
+	// Candidates gathered since the answer was set follow it
+	s.sendDescription(SignalMessage{Type: "answer", SDP: s.peerConn.LocalDescription().SDP})
+}
+
+// restartICEOnFailure offers an ICE restart when connectivity is lost, rather than tearing the viewer down
+func (s *wsSession) restartICEOnFailure(state webrtc.ICEConnectionState) {
+	if state != webrtc.ICEConnectionStateFailed {
+		return
+	}
+	// Called from a pion callback; negotiate off that goroutine
+	go func() {
+		s.negotiateMu.Lock()
+		defer s.negotiateMu.Unlock()
+
+		if s.peerConn.SignalingState() != webrtc.SignalingStateStable {
+			return // Renegotiation already in progress
+		}
+		offer, err := s.peerConn.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+		if err != nil {
+			log.Printf("Failed to create ICE restart offer: %v", err)
+			return
+		}
+		// The candidates for the new credentials must not overtake the offer
+		s.holdCandidates()
+		if err := s.peerConn.SetLocalDescription(offer); err != nil {
+			log.Printf("Failed to set ICE restart offer: %v", err)
+			s.dropCandidates()
+			return
+		}
+		log.Println("ICE failed, offering ICE restart to viewer")
+		s.sendDescription(SignalMessage{Type: "offer", SDP: offer.SDP})
+	}()
+}
+
+func (s *wsSession) sendCandidate(c *webrtc.ICECandidate) {
+	msg := SignalMessage{Type: "candidate"}
+	if c != nil {
+		init := c.ToJSON()
+		msg.Candidate = &init
+	}
+
+	s.candidateMu.Lock()
+	defer s.candidateMu.Unlock()
+	if s.holding {
+		s.held = append(s.held, msg)
+		return
+	}
+	s.send(msg)
+}
+
+// holdCandidates queues local candidates until sendDescription or dropCandidates
+func (s *wsSession) holdCandidates() {
+	s.candidateMu.Lock()
+	s.holding = true
+	s.candidateMu.Unlock()
+}
+
+// sendDescription sends an answer or offer, then the candidates held for it
+func (s *wsSession) sendDescription(msg SignalMessage) {
+	s.candidateMu.Lock()
+	defer s.candidateMu.Unlock()
+	s.send(msg)
+	for _, c := range s.held {
+		s.send(c)
+	}
+	s.holding = false
+	s.held = nil
+}
+
+// dropCandidates stops holding when no description is sent; the held candidates
+// belong to a description the client never sees
+func (s *wsSession) dropCandidates() {
+	s.candidateMu.Lock()
+	s.holding = false
+	s.held = nil
+	s.candidateMu.Unlock()
+}
+
+func (s *wsSession) sendError(reason string) {
+	s.send(SignalMessage{Type: "error", Reason: reason})
+}
+
+func (s *wsSession) send(msg SignalMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("Signaling write error: %v", err)
+	}
+}
+
+// close ends the session from the server side: a close message with the reason
+// (if any), then a WebSocket close frame. Safe to call more than once.
+func (s *wsSession) close(reason string) {
+	s.once.Do(func() {
+		if reason != "" {
+			s.send(SignalMessage{Type: "close", Reason: reason})
+		}
+
+		s.writeMu.Lock()
+		close(s.closed)
+		s.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+			time.Now().Add(wsWriteTimeout))
+		s.writeMu.Unlock()
+
+		s.conn.Close()
+	})
+}
+
+// keepAlive pings the client so dead sockets are noticed by the read deadline
+func (s *wsSession) keepAlive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.writeMu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			s.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"webrtc-ipcam/config"
+)
+
+// VideoSource produces a raw H264 Annex-B byte stream for the CameraManager.
+type VideoSource interface {
+	// Open starts the source and returns a reader for its Annex-B output.
+	// The reader must be closed once the stream ends.
+	Open() (io.ReadCloser, error)
+	// Close stops the source, unblocking any pending reads on the stream.
+	Close() error
+	// String describes the source for logging.
+	String() string
+}
+
+// KeyframeRequester is implemented by sources that can produce an IDR frame on demand.
+type KeyframeRequester interface {
+	RequestKeyframe() error
+}
+
+// ErrKeyframeUnsupported is returned when the running source cannot produce an IDR on demand.
+var ErrKeyframeUnsupported = errors.New("source does not support keyframe requests")
+
+// NewVideoSourceFromConfig builds the video source selected by the "source" config key.
+func NewVideoSourceFromConfig(conf *config.ServerConfig) (VideoSource, error) {
+	switch conf.Source {
+	case "", "rpicam":
+		return NewRpicamSource(conf.Width, conf.Height, conf.Framerate, conf.Rotation, conf.Bitrate), nil
+	case "exec":
+		if conf.CameraCmd == "" {
+			return nil, fmt.Errorf("source \"exec\" requires camera_cmd")
+		}
+		return &ExecSource{Command: conf.CameraCmd}, nil
+	case "pipe":
+		if conf.SourcePath == "" {
+			return nil, fmt.Errorf("source \"pipe\" requires source_path")
+		}
+		return &PipeSource{Path: conf.SourcePath}, nil
+	case "tcp":
+		if conf.SourceAddr == "" {
+			return nil, fmt.Errorf("source \"tcp\" requires source_addr")
+		}
+		return &TCPSource{Addr: conf.SourceAddr}, nil
+	case "file":
+		if conf.SourcePath == "" {
+			return nil, fmt.Errorf("source \"file\" requires source_path")
+		}
+		return &FileSource{Path: conf.SourcePath, Framerate: conf.Framerate, Loop: conf.SourceLoop}, nil
+	default:
+		return nil, fmt.Errorf("unknown source %q", conf.Source)
+	}
+}
+
+// ExecSource runs a shell command and reads H264 from its stdout.
+type ExecSource struct {
+	Command string
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+}
+
+// Open launches the command via "sh -c" with stderr passed through.
+func (s *ExecSource) Open() (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd := exec.Command("sh", "-c", s.Command)
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe error: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start camera: %w", err)
+	}
+	s.cmd = cmd
+
+	log.Printf("Camera process started (PID: %d), streaming H264...", cmd.Process.Pid)
+	return &execStream{ReadCloser: stdout, cmd: cmd, source: s}, nil
+}
+
+// Close asks the running process to exit, force killing it if the signal fails.
+func (s *ExecSource) Close() error {
+	s.mu.Lock()
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+
+	log.Printf("Stopping camera process (PID: %d)...", cmd.Process.Pid)
+
+	// Try graceful shutdown first
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		log.Printf("Graceful shutdown failed, force killing process: %v", err)
+		if killErr := cmd.Process.Kill(); killErr != nil {
+			return fmt.Errorf("failed to kill process: %w", killErr)
+		}
+	}
+	return nil
+}
+
+func (s *ExecSource) String() string {
+	return fmt.Sprintf("exec(%s)", s.Command)
+}
+
+// execStream reaps the child process once its stdout has been consumed.
+type execStream struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	source *ExecSource
+}
+
+func (e *execStream) Close() error {
+	e.ReadCloser.Close()
+	err := e.cmd.Wait()
+
+	// Forget the reaped process so Close does not signal it
+	e.source.mu.Lock()
+	if e.source.cmd == e.cmd {
+		e.source.cmd = nil
+	}
+	e.source.mu.Unlock()
+	return err
+}
+
+// RpicamSource streams from the Raspberry Pi camera using rpicam-vid.
+type RpicamSource struct {
+	ExecSource
+}
+
+// NewRpicamSource builds the rpicam-vid command line for the given capture settings.
+// A bitrate of 0 lets rpicam-vid choose automatically.
+func NewRpicamSource(width, height, framerate, rotation, bitrate int) *RpicamSource {
+	cameraCmd := fmt.Sprintf(
+		"rpicam-vid -t 0 --width %d --height %d --framerate %d --inline --rotation %d --codec h264 --nopreview -o -",
+		width, height, framerate, rotation,
+	)
+	// Add bitrate limiting if configured (critical for Pi Zero 2 performance)
+	if bitrate > 0 {
+		cameraCmd += fmt.Sprintf(" --bitrate %d", bitrate)
+	}
+	return &RpicamSource{ExecSource: ExecSource{Command: cameraCmd}}
+}
+
+func (s *RpicamSource) String() string {
+	return "rpicam-vid"
+}
+
+// PipeSource reads H264 from a named pipe (FIFO) created with mkfifo.
+type PipeSource struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the FIFO read-write so the call does not block waiting for a
+// writer, and so a writer restarting does not end the stream with EOF.
+func (s *PipeSource) Open() (io.ReadCloser, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("pipe not accessible: %w", err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a named pipe", s.Path)
+	}
+
+	f, err := os.OpenFile(s.Path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pipe: %w", err)
+	}
+
+	s.mu.Lock()
+	s.file = f
+	s.mu.Unlock()
+
+	log.Printf("Reading H264 from pipe %s", s.Path)
+	return f, nil
+}
+
+func (s *PipeSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *PipeSource) String() string {
+	return fmt.Sprintf("pipe(%s)", s.Path)
+}
+
+// TCPSource listens on a TCP address and reads H264 from the first connection,
+// e.g. `ffmpeg -re -i clip.mp4 -c:v copy -f h264 tcp://pi:5000`.
+type TCPSource struct {
+	Addr string
+
+	mu     sync.Mutex
+	stream *tcpStream
+}
+
+// Open starts listening. The peer is accepted lazily on the first read so the
+// camera can start before anything connects.
+func (s *TCPSource) Open() (io.ReadCloser, error) {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", s.Addr, err)
+	}
+
+	stream := &tcpStream{listener: ln}
+	s.mu.Lock()
+	s.stream = stream
+	s.mu.Unlock()
+
+	log.Printf("Waiting for H264 stream on tcp://%s", ln.Addr())
+	return stream, nil
+}
+
+func (s *TCPSource) Close() error {
+	s.mu.Lock()
+	stream := s.stream
+	s.stream = nil
+	s.mu.Unlock()
+	if stream == nil {
+		return nil
+	}
+	return stream.Close()
+}
+
+func (s *TCPSource) String() string {
+	return fmt.Sprintf("tcp(%s)", s.Addr)
+}
+
+type tcpStream struct {
+	listener net.Listener
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (t *tcpStream) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+
+	if conn == nil {
+		c, err := t.listener.Accept()
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("H264 sender connected from %s", c.RemoteAddr())
+
+		t.mu.Lock()
+		t.conn = c
+		t.mu.Unlock()
+		conn = c
+	}
+	return conn.Read(p)
+}
+
+func (t *tcpStream) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	return t.listener.Close()
+}
+
+// FileSource replays a local Annex-B .h264 file, such as a raw recording.
+// With a Framerate set, NAL units are released at that rate so the file
+// behaves like a live camera; with Loop set, playback restarts at EOF.
+type FileSource struct {
+	Path      string
+	Framerate int
+	Loop      bool
+
+	mu     sync.Mutex
+	stream *fileReplayStream
+}
+
+func (s *FileSource) Open() (io.ReadCloser, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	stream := &fileReplayStream{
+		file: f,
+		loop: s.Loop,
+		done: make(chan struct{}),
+	}
+	if s.Framerate > 0 {
+		stream.interval = time.Second / time.Duration(s.Framerate)
+	}
+
+	s.mu.Lock()
+	s.stream = stream
+	s.mu.Unlock()
+
+	log.Printf("Replaying H264 from file %s (%dfps, loop=%v)", s.Path, s.Framerate, s.Loop)
+	return stream, nil
+}
+
+func (s *FileSource) Close() error {
+	s.mu.Lock()
+	stream := s.stream
+	s.stream = nil
+	s.mu.Unlock()
+	if stream == nil {
+		return nil
+	}
+	return stream.Close()
+}
+
+// RequestKeyframe skips the rest of the current GOP so replay continues at the next IDR.
+func (s *FileSource) RequestKeyframe() error {
+	s.mu.Lock()
+	stream := s.stream
+	s.mu.Unlock()
+	if stream == nil {
+		return fmt.Errorf("file source is not open")
+	}
+	stream.skipToIDR.Store(true)
+	return nil
+}
+
+func (s *FileSource) String() string {
+	return fmt.Sprintf("file(%s)", s.Path)
+}
+
+// fileReplayStream re-emits a file NAL unit by NAL unit, sleeping before
+// the first NAL unit of each access unit to hold the configured frame
+// interval, so parameter sets reach the reader together with their picture.
+type fileReplayStream struct {
+	file     *os.File
+	loop     bool
+	interval time.Duration
+
+	buf     []byte   // Bytes read from file but not yet split
+	pending [][]byte // Split NAL units waiting to be served
+	cur     []byte   // Unread remainder of the NAL unit being served
+	served  bool     // Whether the current pass over the file yielded any NAL unit
+	hasVCL  bool     // Whether the access unit being served has a slice yet
+	next    time.Time
+
+	skipToIDR atomic.Bool // Set by RequestKeyframe; drop NAL units until the next SPS/PPS/IDR
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (f *fileReplayStream) Read(p []byte) (int, error) {
+	for len(f.cur) == 0 {
+		nalu, err := f.nextNALU()
+		if err != nil {
+			return 0, err
+		}
+		if f.skipToIDR.Load() {
+			switch naluType(nalu) {
+			case naluTypeSPS, naluTypePPS, naluTypeIDR:
+				f.skipToIDR.Store(false)
+			default:
+				continue
+			}
+		}
+		if startsAccessUnit(nalu, f.hasVCL) {
+			f.hasVCL = false
+			if f.interval > 0 {
+				if err := f.waitForFrame(); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if isVCL(naluType(nalu)) {
+			f.hasVCL = true
+		}
+		f.cur = nalu
+	}
+
+	n := copy(p, f.cur)
+	f.cur = f.cur[n:]
+	return n, nil
+}
+
+// nextNALU returns the next NAL unit from the file, rewinding at EOF when looping.
+func (f *fileReplayStream) nextNALU() ([]byte, error) {
+	chunk := make([]byte, 64*1024)
+	for len(f.pending) == 0 {
+		n, err := f.file.Read(chunk)
+		if n > 0 {
+			f.buf = append(f.buf, chunk[:n]...)
+			f.pending, f.buf = splitNALUs(f.buf)
+			continue
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+
+		// The last NAL unit has no start code after it
+		if findNALUStart(f.buf) == 0 && len(f.buf) > 4 {
+			f.pending = append(f.pending, f.buf)
+		}
+		f.buf = nil
+		if len(f.pending) > 0 {
+			break
+		}
+
+		if !f.loop {
+			return nil, io.EOF
+		}
+		if !f.served {
+			return nil, fmt.Errorf("file contains no H264 NAL units")
+		}
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		f.served = false
+	}
+
+	nalu := f.pending[0]
+	f.pending = f.pending[1:]
+	f.served = true
+	return nalu, nil
+}
+
+// waitForFrame sleeps until the next frame is due, resyncing after stalls
+// instead of bursting to catch up.
+func (f *fileReplayStream) waitForFrame() error {
+	now := time.Now()
+	if f.next.IsZero() || now.Sub(f.next) > time.Second {
+		f.next = now
+	}
+
+	if wait := f.next.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-f.done:
+			return io.EOF
+		}
+	}
+
+	f.next = f.next.Add(f.interval)
+	return nil
+}
+
+func (f *fileReplayStream) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.done)
+		err = f.file.Close()
+	})
+	return err
+}
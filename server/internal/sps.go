@@ -0,0 +1,516 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SPSInfo holds the fields of an H264 sequence parameter set that describe the stream
+type SPSInfo struct {
+	ID              uint32
+	ProfileIDC      uint8
+	ConstraintFlags uint8 // constraint_set0..5 flags, as the byte following profile_idc
+	LevelIDC        uint8
+	ChromaFormatIDC uint32
+	BitDepthLuma    uint32 // Bits per sample, 8 unless signalled otherwise
+	BitDepthChroma  uint32
+	Width           int     // Display width after cropping
+	Height          int     // Display height after cropping
+	Framerate       float64 // From VUI timing info, 0 if not signalled
+	FixedFrameRate  bool
+	MaxNumRefFrames uint32
+}
+
+// PPSInfo holds the fields of an H264 picture parameter set
+type PPSInfo struct {
+	ID    uint32
+	SPSID uint32
+	CABAC bool // entropy_coding_mode_flag
+}
+
+// StreamInfo describes the H264 stream produced by the camera, as parsed from its SPS/PPS
+type StreamInfo struct {
+	Profile        string  `json:"profile"`
+	ProfileIDC     uint8   `json:"profileIdc"`
+	Level          string  `json:"level"`
+	ProfileLevelID string  `json:"profileLevelId"` // SDP fmtp profile-level-id (hex)
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	Framerate      float64 `json:"framerate,omitempty"`
+	EntropyCoding  string  `json:"entropyCoding,omitempty"`
+}
+
+var errBitstreamEnd = errors.New("unexpected end of bitstream")
+
+// bitReader reads the RBSP bit syntax used in H264 parameter sets
+type bitReader struct {
+	data []byte
+	pos  int // bit position
+}
+
+func (b *bitReader) u1() (uint32, error) {
+	if b.pos >= len(b.data)*8 {
+		return 0, errBitstreamEnd
+	}
+	bit := (b.data[b.pos/8] >> (7 - uint(b.pos%8))) & 1
+	b.pos++
+	return uint32(bit), nil
+}
+
+func (b *bitReader) u(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit, err := b.u1()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+func (b *bitReader) flag() (bool, error) {
+	v, err := b.u1()
+	return v == 1, err
+}
+
+// ue reads an unsigned exp-Golomb code
+func (b *bitReader) ue() (uint32, error) {
+	leadingZeros := 0
+	for {
+		bit, err := b.u1()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		leadingZeros++
+		if leadingZeros > 31 {
+			return 0, fmt.Errorf("invalid exp-Golomb code")
+		}
+	}
+	rest, err := b.u(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<leadingZeros - 1) + rest, nil
+}
+
+// se reads a signed exp-Golomb code
+func (b *bitReader) se() (int32, error) {
+	v, err := b.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32(v/2 + 1), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03 -> 00 00)
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, c := range data {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// hasChromaFormatInfo reports whether an SPS of the profile signals its chroma
+// format and bit depths (High profiles and their extensions, 7.3.2.1.1); the
+// avcC of such a stream carries them too
+func hasChromaFormatInfo(profileIDC uint8) bool {
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+// ParseSPS parses an Annex-B (or bare) SPS NAL unit
+func ParseSPS(nalu []byte) (*SPSInfo, error) {
+	payload := naluPayload(nalu)
+	if len(payload) < 4 || payload[0]&0x1F != naluTypeSPS {
+		return nil, fmt.Errorf("not an SPS NAL unit")
+	}
+	rbsp := unescapeRBSP(payload[1:])
+	if len(rbsp) < 4 {
+		return nil, fmt.Errorf("invalid SPS: %w", errBitstreamEnd)
+	}
+
+	sps := &SPSInfo{
+		ProfileIDC:      rbsp[0],
+		ConstraintFlags: rbsp[1],
+		LevelIDC:        rbsp[2],
+		ChromaFormatIDC: 1, // 4:2:0 unless signalled otherwise
+		BitDepthLuma:    8,
+		BitDepthChroma:  8,
+	}
+	if err := sps.parseBody(&bitReader{data: rbsp[3:]}); err != nil {
+		return nil, fmt.Errorf("invalid SPS: %w", err)
+	}
+	return sps, nil
+}
+
+func (sps *SPSInfo) parseBody(b *bitReader) error {
+	var err error
+	if sps.ID, err = b.ue(); err != nil {
+		return err
+	}
+
+	separateColourPlane := false
+	if hasChromaFormatInfo(sps.ProfileIDC) {
+		if sps.ChromaFormatIDC, err = b.ue(); err != nil {
+			return err
+		}
+		if sps.ChromaFormatIDC == 3 {
+			if separateColourPlane, err = b.flag(); err != nil {
+				return err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		for _, depth := range []*uint32{&sps.BitDepthLuma, &sps.BitDepthChroma} {
+			minus8, err := b.ue()
+			if err != nil {
+				return err
+			}
+			*depth = minus8 + 8
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err := b.u1(); err != nil {
+			return err
+		}
+		scalingMatrixPresent, err := b.flag()
+		if err != nil {
+			return err
+		}
+		if scalingMatrixPresent {
+			lists := 8
+			if sps.ChromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := b.flag()
+				if err != nil {
+					return err
+				}
+				if !present {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(b, size); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	if _, err := b.ue(); err != nil {
+		return err
+	}
+
+	pocType, err := b.ue()
+	if err != nil {
+		return err
+	}
+	switch pocType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		if _, err := b.ue(); err != nil {
+			return err
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag
+		if _, err := b.u1(); err != nil {
+			return err
+		}
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		for range 2 {
+			if _, err := b.se(); err != nil {
+				return err
+			}
+		}
+		cycle, err := b.ue()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < cycle; i++ {
+			if _, err := b.se(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sps.MaxNumRefFrames, err = b.ue(); err != nil {
+		return err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err := b.u1(); err != nil {
+		return err
+	}
+
+	widthMbs, err := b.ue()
+	if err != nil {
+		return err
+	}
+	heightMapUnits, err := b.ue()
+	if err != nil {
+		return err
+	}
+	frameMbsOnly, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if !frameMbsOnly {
+		// mb_adaptive_frame_field_flag
+		if _, err := b.u1(); err != nil {
+			return err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err := b.u1(); err != nil {
+		return err
+	}
+
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	sps.Width = int(widthMbs+1) * 16
+	sps.Height = fieldFactor * int(heightMapUnits+1) * 16
+
+	cropping, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if cropping {
+		var crop [4]uint32 // left, right, top, bottom
+		for i := range crop {
+			if crop[i], err = b.ue(); err != nil {
+				return err
+			}
+		}
+		// Crop units depend on chroma subsampling (Table 6-1)
+		cropX, cropY := 1, fieldFactor
+		if sps.ChromaFormatIDC != 0 && !separateColourPlane {
+			switch sps.ChromaFormatIDC {
+			case 1:
+				cropX, cropY = 2, 2*fieldFactor
+			case 2:
+				cropX = 2
+			}
+		}
+		sps.Width -= cropX * int(crop[0]+crop[1])
+		sps.Height -= cropY * int(crop[2]+crop[3])
+	}
+
+	vuiPresent, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if vuiPresent {
+		return sps.parseVUI(b)
+	}
+	return nil
+}
+
+// parseVUI reads the VUI fields up to and including timing info
+func (sps *SPSInfo) parseVUI(b *bitReader) error {
+	aspectRatioPresent, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if aspectRatioPresent {
+		idc, err := b.u(8)
+		if err != nil {
+			return err
+		}
+		if idc == 255 { // Extended_SAR: sar_width, sar_height
+			if _, err := b.u(32); err != nil {
+				return err
+			}
+		}
+	}
+
+	overscanPresent, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if overscanPresent {
+		if _, err := b.u1(); err != nil {
+			return err
+		}
+	}
+
+	videoSignalPresent, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if videoSignalPresent {
+		// video_format, video_full_range_flag
+		if _, err := b.u(4); err != nil {
+			return err
+		}
+		colourDescriptionPresent, err := b.flag()
+		if err != nil {
+			return err
+		}
+		if colourDescriptionPresent {
+			// colour_primaries, transfer_characteristics, matrix_coefficients
+			if _, err := b.u(24); err != nil {
+				return err
+			}
+		}
+	}
+
+	chromaLocPresent, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if chromaLocPresent {
+		for range 2 {
+			if _, err := b.ue(); err != nil {
+				return err
+			}
+		}
+	}
+
+	timingPresent, err := b.flag()
+	if err != nil {
+		return err
+	}
+	if timingPresent {
+		unitsInTick, err := b.u(32)
+		if err != nil {
+			return err
+		}
+		timeScale, err := b.u(32)
+		if err != nil {
+			return err
+		}
+		if sps.FixedFrameRate, err = b.flag(); err != nil {
+			return err
+		}
+		// One frame spans two ticks (one per field)
+		if unitsInTick > 0 {
+			sps.Framerate = float64(timeScale) / float64(2*unitsInTick)
+		}
+	}
+	return nil
+}
+
+// skipScalingList consumes a scaling_list() of the given size
+func skipScalingList(b *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			delta, err := b.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// ParsePPS parses the leading fields of an Annex-B (or bare) PPS NAL unit
+func ParsePPS(nalu []byte) (*PPSInfo, error) {
+	payload := naluPayload(nalu)
+	if len(payload) < 2 || payload[0]&0x1F != naluTypePPS {
+		return nil, fmt.Errorf("not a PPS NAL unit")
+	}
+	b := &bitReader{data: unescapeRBSP(payload[1:])}
+
+	pps := &PPSInfo{}
+	var err error
+	if pps.ID, err = b.ue(); err != nil {
+		return nil, fmt.Errorf("invalid PPS: %w", err)
+	}
+	if pps.SPSID, err = b.ue(); err != nil {
+		return nil, fmt.Errorf("invalid PPS: %w", err)
+	}
+	if pps.CABAC, err = b.flag(); err != nil {
+		return nil, fmt.Errorf("invalid PPS: %w", err)
+	}
+	return pps, nil
+}
+
+// ProfileLevelID returns the SDP fmtp profile-level-id for this SPS
+func (sps *SPSInfo) ProfileLevelID() string {
+	return fmt.Sprintf("%02x%02x%02x", sps.ProfileIDC, sps.ConstraintFlags, sps.LevelIDC)
+}
+
+// ProfileName returns the human readable H264 profile name
+func (sps *SPSInfo) ProfileName() string {
+	constraintSet1 := sps.ConstraintFlags&0x40 != 0
+	switch sps.ProfileIDC {
+	case 66:
+		if constraintSet1 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
+	default:
+		return fmt.Sprintf("profile_idc %d", sps.ProfileIDC)
+	}
+}
+
+// LevelName returns the H264 level as written in the spec, e.g. "3.1" or "1b"
+func (sps *SPSInfo) LevelName() string {
+	constraintSet3 := sps.ConstraintFlags&0x10 != 0
+	if sps.LevelIDC == 9 || (sps.LevelIDC == 11 && constraintSet3 && sps.ProfileIDC <= 88) {
+		return "1b"
+	}
+	return fmt.Sprintf("%d.%d", sps.LevelIDC/10, sps.LevelIDC%10)
+}
+
+// NewStreamInfo summarizes a parsed SPS (and optional PPS) for status reporting
+func NewStreamInfo(sps *SPSInfo, pps *PPSInfo) *StreamInfo {
+	info := &StreamInfo{
+		Profile:        sps.ProfileName(),
+		ProfileIDC:     sps.ProfileIDC,
+		Level:          sps.LevelName(),
+		ProfileLevelID: sps.ProfileLevelID(),
+		Width:          sps.Width,
+		Height:         sps.Height,
+		Framerate:      sps.Framerate,
+	}
+	if pps != nil {
+		info.EntropyCoding = "CAVLC"
+		if pps.CABAC {
+			info.EntropyCoding = "CABAC"
+		}
+	}
+	return info
+}
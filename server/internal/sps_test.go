@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Parameter sets shared by the H264 and MP4 tests
+var (
+	// Constrained Baseline 640x480, level 3.0, VUI timing at a fixed 30fps
+	testSPSBaseline = []byte{
+		0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x3d, 0xa1, 0x00, 0x00, 0x03,
+		0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x3c, 0x8f, 0x16, 0x2e, 0x48,
+	}
+	// rpicam-vid, High 1280x720, level 4.0, VUI without timing
+	testSPSHigh720 = []byte{
+		0x27, 0x64, 0x00, 0x28, 0xac, 0x2b, 0x40, 0x28, 0x02, 0xdd, 0x00, 0xf1,
+		0x22, 0x6a,
+	}
+	// High 1920x1080, level 4.0: 1088 coded rows cropped to 1080, 30fps, and
+	// emulation prevention bytes in its VUI
+	testSPSHigh1080 = []byte{
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0xc0,
+		0x44, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c,
+		0x60, 0xc6, 0x58,
+	}
+	// High 4:2:2 10-bit 1920x1080, level 3.1, no VUI (encoded by hand)
+	testSPSHigh422 = []byte{0x67, 0x7a, 0x00, 0x1f, 0xb6, 0xcb, 0x40, 0x3c, 0x01, 0x13, 0xf1, 0x28}
+
+	testPPSCAVLC = []byte{0x68, 0xce, 0x3c, 0x80}
+	testPPSCABAC = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name           string
+		nalu           []byte
+		want           SPSInfo
+		profileLevelID string
+		profile        string
+		level          string
+	}{
+		{
+			name: "baseline",
+			nalu: testSPSBaseline,
+			want: SPSInfo{
+				ProfileIDC: 66, ConstraintFlags: 0xc0, LevelIDC: 30,
+				ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Width: 640, Height: 480, Framerate: 30, FixedFrameRate: true, MaxNumRefFrames: 3,
+			},
+			profileLevelID: "42c01e",
+			profile:        "Constrained Baseline",
+			level:          "3.0",
+		},
+		{
+			name: "high 720p",
+			nalu: testSPSHigh720,
+			want: SPSInfo{
+				ProfileIDC: 100, LevelIDC: 40,
+				ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Width: 1280, Height: 720, MaxNumRefFrames: 1,
+			},
+			profileLevelID: "640028",
+			profile:        "High",
+			level:          "4.0",
+		},
+		{
+			name: "high cropped 1080p",
+			nalu: testSPSHigh1080,
+			want: SPSInfo{
+				ProfileIDC: 100, LevelIDC: 40,
+				ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Width: 1920, Height: 1080, Framerate: 30, MaxNumRefFrames: 4,
+			},
+			profileLevelID: "640028",
+			profile:        "High",
+			level:          "4.0",
+		},
+		{
+			name: "high 4:2:2 10-bit",
+			nalu: testSPSHigh422,
+			want: SPSInfo{
+				ProfileIDC: 122, LevelIDC: 31,
+				ChromaFormatIDC: 2, BitDepthLuma: 10, BitDepthChroma: 10,
+				Width: 1920, Height: 1080, MaxNumRefFrames: 1,
+			},
+			profileLevelID: "7a001f",
+			profile:        "High 4:2:2",
+			level:          "3.1",
+		},
+		{
+			name: "annex-b start code",
+			nalu: append([]byte{0, 0, 0, 1}, testSPSBaseline...),
+			want: SPSInfo{
+				ProfileIDC: 66, ConstraintFlags: 0xc0, LevelIDC: 30,
+				ChromaFormatIDC: 1, BitDepthLuma: 8, BitDepthChroma: 8,
+				Width: 640, Height: 480, Framerate: 30, FixedFrameRate: true, MaxNumRefFrames: 3,
+			},
+			profileLevelID: "42c01e",
+			profile:        "Constrained Baseline",
+			level:          "3.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sps, err := ParseSPS(tt.nalu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *sps != tt.want {
+				t.Errorf("ParseSPS = %+v, want %+v", *sps, tt.want)
+			}
+			if got := sps.ProfileLevelID(); got != tt.profileLevelID {
+				t.Errorf("ProfileLevelID = %s, want %s", got, tt.profileLevelID)
+			}
+			if got := sps.ProfileName(); got != tt.profile {
+				t.Errorf("ProfileName = %s, want %s", got, tt.profile)
+			}
+			if got := sps.LevelName(); got != tt.level {
+				t.Errorf("LevelName = %s, want %s", got, tt.level)
+			}
+		})
+	}
+}
+
+func TestParseSPSInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		nalu []byte
+		want string
+	}{
+		{"PPS", testPPSCABAC, "not an SPS"},
+		{"empty", nil, "not an SPS"},
+		{"header only", testSPSHigh1080[:4], "unexpected end"},
+		{"truncated before the size", testSPSHigh1080[:7], "unexpected end"},
+		{"truncated in the VUI", testSPSHigh1080[:12], "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sps, err := ParseSPS(tt.nalu)
+			if err == nil {
+				t.Fatalf("ParseSPS = %+v, want an error", *sps)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseSPS error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePPS(t *testing.T) {
+	tests := []struct {
+		name    string
+		nalu    []byte
+		cabac   bool
+		entropy string
+	}{
+		{"CAVLC", testPPSCAVLC, false, "CAVLC"},
+		{"CABAC", testPPSCABAC, true, "CABAC"},
+	}
+	sps, err := ParseSPS(testSPSHigh1080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pps, err := ParsePPS(tt.nalu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pps.ID != 0 || pps.SPSID != 0 || pps.CABAC != tt.cabac {
+				t.Errorf("ParsePPS = %+v, want CABAC %v", *pps, tt.cabac)
+			}
+			if info := NewStreamInfo(sps, pps); info.EntropyCoding != tt.entropy {
+				t.Errorf("EntropyCoding = %s, want %s", info.EntropyCoding, tt.entropy)
+			}
+		})
+	}
+
+	if _, err := ParsePPS(testSPSBaseline); err == nil {
+		t.Error("ParsePPS accepted an SPS")
+	}
+}
+
+// bits packs a string of 0s and 1s into bytes, padded with zeros
+func bits(s string) []byte {
+	b := make([]byte, (len(s)+7)/8)
+	for i, c := range s {
+		if c == '1' {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return b
+}
+
+func TestBitReaderExpGolomb(t *testing.T) {
+	tests := []struct {
+		bits string
+		ue   uint32
+		se   int32
+	}{
+		{"1", 0, 0},
+		{"010", 1, 1},
+		{"011", 2, -1},
+		{"00100", 3, 2},
+		{"00101", 4, -2},
+		{"00111", 6, -3},
+		{"0001000", 7, 4},
+		{"000010001", 16, -8},
+		{strings.Repeat("0", 31) + "1" + strings.Repeat("1", 31), 1<<32 - 2, -(1<<31 - 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bits, func(t *testing.T) {
+			b := &bitReader{data: bits(tt.bits)}
+			if v, err := b.ue(); err != nil || v != tt.ue {
+				t.Errorf("ue = %d, %v, want %d", v, err, tt.ue)
+			}
+			if b.pos != len(tt.bits) {
+				t.Errorf("ue read %d bits, want %d", b.pos, len(tt.bits))
+			}
+			b = &bitReader{data: bits(tt.bits)}
+			if v, err := b.se(); err != nil || v != tt.se {
+				t.Errorf("se = %d, %v, want %d", v, err, tt.se)
+			}
+		})
+	}
+
+	// Codes running past the data, and longer than 32 bits
+	b := &bitReader{data: bits("00000000")}
+	if _, err := b.ue(); !errors.Is(err, errBitstreamEnd) {
+		t.Errorf("ue of zeros: %v, want %v", err, errBitstreamEnd)
+	}
+	b = &bitReader{data: bits(strings.Repeat("0", 32) + "1")}
+	if _, err := b.ue(); err == nil || errors.Is(err, errBitstreamEnd) {
+		t.Errorf("ue of a 33-bit code: %v, want an invalid code", err)
+	}
+}
+
+func TestUnescapeRBSP(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"none", []byte{0x00, 0x03, 0x00, 0x01}, []byte{0x00, 0x03, 0x00, 0x01}},
+		{"one", []byte{0x00, 0x00, 0x03, 0x01}, []byte{0x00, 0x00, 0x01}},
+		{"consecutive", []byte{0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00}, []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"after three zeros", []byte{0x00, 0x00, 0x00, 0x03}, []byte{0x00, 0x00, 0x00}},
+		{"trailing", []byte{0xff, 0x00, 0x00, 0x03}, []byte{0xff, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unescapeRBSP(tt.in); !bytes.Equal(got, tt.want) {
+				t.Errorf("unescapeRBSP(% x) = % x, want % x", tt.in, got, tt.want)
+			}
+		})
+	}
+}
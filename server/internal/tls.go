@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-ipcam/config"
+)
+
+const (
+	selfSignedValidity    = 365 * 24 * time.Hour
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+	certPollInterval      = 10 * time.Second
+)
+
+// CertReloader serves the HTTPS certificate, reloading it when the files change
+// so renewed certificates are picked up without a restart. Only new TLS
+// handshakes see the new certificate; open connections and WebRTC peers, which
+// use their own DTLS certificates, are unaffected.
+type CertReloader struct {
+	certFile   string
+	keyFile    string
+	selfSigned bool
+	hosts      []string // Names and IPs for the self-signed certificate
+	tlsHosts   []string // Configured names the self-signed certificate must cover
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	version string // Modification times and sizes of the loaded files
+
+	done chan struct{}
+}
+
+// NewCertReloader loads conf.TLSCert and conf.TLSKey, first generating a
+// self-signed certificate if none was provided, and watches them for changes
+func NewCertReloader(conf *config.ServerConfig) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile:   conf.TLSCert,
+		keyFile:    conf.TLSKey,
+		selfSigned: conf.TLSSelfSigned,
+		tlsHosts:   conf.TLSHosts,
+		done:       make(chan struct{}),
+	}
+	if c.selfSigned {
+		c.hosts = selfSignedHosts(conf)
+		if err := c.ensureSelfSigned(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	go c.watch()
+	return c, nil
+}
+
+// GetCertificate is the tls.Config callback returning the current certificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Close stops watching the certificate files
+func (c *CertReloader) Close() {
+	close(c.done)
+}
+
+// watch polls the files, which also catches renewals that replace them by rename
+func (c *CertReloader) watch() {
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		if c.selfSigned && time.Until(c.expiry()) < selfSignedRenewBefore {
+			if err := c.ensureSelfSigned(); err != nil {
+				log.Printf("Failed to renew self-signed certificate: %v", err)
+			}
+		}
+		if err := c.reload(); err != nil {
+			// Typically caught between the certificate and key being replaced; retried next poll
+			log.Printf("Failed to reload TLS certificate, keeping the current one: %v", err)
+		}
+	}
+}
+
+func (c *CertReloader) expiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert.Leaf.NotAfter
+}
+
+// reload loads the files if they changed since the last load
+func (c *CertReloader) reload() error {
+	version, err := fileVersion(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	unchanged := version == c.version
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("TLS certificate %s: %w", c.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("TLS certificate %s: %w", c.certFile, err)
+		}
+	}
+
+	c.mu.Lock()
+	reloaded := c.cert != nil
+	c.cert = &cert
+	c.version = version
+	c.mu.Unlock()
+
+	action := "Loaded"
+	if reloaded {
+		action = "Reloaded"
+	}
+	log.Printf("%s TLS certificate %s for %s, expires %s, SHA-256 fingerprint %s", action, c.certFile,
+		strings.Join(certNames(cert.Leaf), ", "), cert.Leaf.NotAfter.Format(time.RFC3339), certFingerprint(cert.Leaf))
+	if time.Until(cert.Leaf.NotAfter) < 0 {
+		log.Printf("WARNING: TLS certificate %s has expired", c.certFile)
+	}
+	return nil
+}
+
+// ensureSelfSigned generates the self-signed certificate when it is missing,
+// unreadable, close to expiry or does not cover every host in tls_hosts
+func (c *CertReloader) ensureSelfSigned() error {
+	if cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > selfSignedRenewBefore && coversHosts(leaf, c.tlsHosts) {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.certFile), 0755); err != nil {
+		return fmt.Errorf("self-signed certificate: %w", err)
+	}
+	certPEM, keyPEM, err := generateSelfSigned(c.hosts)
+	if err != nil {
+		return fmt.Errorf("self-signed certificate: %w", err)
+	}
+	// The key is written first so a reload never pairs the new certificate with the old key
+	if err := writeFileAtomic(c.keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("self-signed certificate: %w", err)
+	}
+	if err := writeFileAtomic(c.certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("self-signed certificate: %w", err)
+	}
+	log.Printf("Generated self-signed certificate %s for %s", c.certFile, strings.Join(c.hosts, ", "))
+	return nil
+}
+
+// generateSelfSigned returns a PEM certificate and ECDSA P-256 key valid for hosts
+func generateSelfSigned(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"PetWebRTC self-signed"}},
+		NotBefore:             now.Add(-time.Hour), // Tolerate clients with slightly slow clocks
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// selfSignedHosts lists the names a browser may use to reach this server: the
+// configured tls_hosts, the host name, localhost and the local and public IPs
+func selfSignedHosts(conf *config.ServerConfig) []string {
+	hosts := append([]string{}, conf.TLSHosts...)
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname, hostname+".local")
+	}
+	hosts = append(hosts, "localhost", "127.0.0.1", "::1")
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				hosts = append(hosts, ipNet.IP.String())
+			}
+		}
+	}
+	hosts = append(hosts, conf.ICENAT1To1IPs...)
+	if conf.TURNPublicIP != "" {
+		hosts = append(hosts, conf.TURNPublicIP)
+	}
+
+	var unique []string
+	for _, host := range hosts {
+		if !slices.Contains(unique, host) {
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+// coversHosts reports whether the certificate is valid for every host
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// certFingerprint formats the SHA-256 fingerprint the way browsers show it, so
+// a self-signed certificate can be checked before accepting the warning
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// fileVersion identifies the current contents of files by modification time and size
+func fileVersion(paths ...string) (string, error) {
+	var version strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&version, "%s:%d:%d;", path, info.ModTime().UnixNano(), info.Size())
+	}
+	return version.String(), nil
+}
+
+// writeFileAtomic writes to a temp file and renames it, so readers never see a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// HTTPSRedirect redirects plain HTTP requests to the same URL on the HTTPS port
+func HTTPSRedirect(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of API calls; 301 is understood by every browser
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"webrtc-ipcam/config"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// TURNServer is an embedded TURN relay for viewers whose NAT defeats direct ICE.
+// Credentials are short-lived and derived from a shared secret (the TURN REST API
+// scheme: username is the expiry time, password an HMAC of it), so nothing has to
+// be provisioned per viewer and leaked credentials expire on their own.
+type TURNServer struct {
+	server   *turn.Server
+	secret   string
+	port     int
+	publicIP string // Advertised to clients; empty uses the host they connected to
+	ttl      time.Duration
+}
+
+// StartTURNServer listens for TURN over UDP and TCP on conf.TURNPort
+func StartTURNServer(conf *config.ServerConfig) (*TURNServer, error) {
+	secret := conf.TURNSecret
+	if secret == "" {
+		// Credentials from a previous run stop working after a restart, which is fine for short-lived ones
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("TURN secret: %w", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	relayIP, err := turnRelayIP(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Relayed traffic is bound on all interfaces and advertised as relayIP
+	var relayGenerator turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: relayIP,
+		Address:      "0.0.0.0",
+	}
+	if conf.TURNRelayPortMin > 0 {
+		relayGenerator = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			MinPort:      uint16(conf.TURNRelayPortMin),
+			MaxPort:      uint16(conf.TURNRelayPortMax),
+			Address:      "0.0.0.0",
+		}
+	}
+
+	addr := ":" + strconv.Itoa(conf.TURNPort)
+	udpConn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("TURN UDP listener on port %d: %w", conf.TURNPort, err)
+	}
+	tcpListener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("TURN TCP listener on port %d: %w", conf.TURNPort, err)
+	}
+
+	permissions := turnPermissionHandler(conf, relayIP)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       conf.TURNRealm,
+		AuthHandler: turn.NewLongTermAuthHandler(secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpConn, RelayAddressGenerator: relayGenerator, PermissionHandler: permissions},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: relayGenerator, PermissionHandler: permissions},
+		},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("TURN server: %w", err)
+	}
+
+	relayPorts := "ephemeral ports"
+	if conf.TURNRelayPortMin > 0 {
+		relayPorts = fmt.Sprintf("ports %d-%d", conf.TURNRelayPortMin, conf.TURNRelayPortMax)
+	}
+	log.Printf("TURN server listening on UDP/TCP port %d, relaying on %s %s, credentials valid %d minutes",
+		conf.TURNPort, relayIP, relayPorts, conf.TURNCredentialMinutes)
+
+	return &TURNServer{
+		server:   server,
+		secret:   secret,
+		port:     conf.TURNPort,
+		publicIP: conf.TURNPublicIP,
+		ttl:      time.Duration(conf.TURNCredentialMinutes) * time.Minute,
+	}, nil
+}
+
+// ICEServer returns fresh credentials for one client. host is where the client
+// reached the HTTP server, used when no public IP is configured.
+func (t *TURNServer) ICEServer(host string) (webrtc.ICEServer, error) {
+	username, password, err := turn.GenerateLongTermCredentials(t.secret, t.ttl)
+	if err != nil {
+		return webrtc.ICEServer{}, err
+	}
+	if t.publicIP != "" {
+		host = t.publicIP
+	}
+	hostPort := net.JoinHostPort(host, strconv.Itoa(t.port))
+	return webrtc.ICEServer{
+		URLs: []string{
+			"turn:" + hostPort + "?transport=udp",
+			"turn:" + hostPort + "?transport=tcp",
+		},
+		Username:       username,
+		Credential:     password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}, nil
+}
+
+// Close stops the TURN server and drops all allocations
+func (t *TURNServer) Close() error {
+	return t.server.Close()
+}
+
+// ClientICEServers returns the ICE servers a viewer should use: the configured
+// STUN/TURN servers plus the embedded TURN server, if running, with fresh credentials
+func ClientICEServers(r *http.Request, conf *config.ServerConfig, turnServer *TURNServer) []webrtc.ICEServer {
+	servers := peerConfiguration(conf).ICEServers
+	if turnServer == nil {
+		return servers
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	server, err := turnServer.ICEServer(host)
+	if err != nil {
+		log.Printf("Failed to generate TURN credentials: %v", err)
+		return servers
+	}
+	return append(servers, server)
+}
+
+// HandleICEServers returns the ICE servers for a new peer connection, in RTCIceServer form
+func HandleICEServers(w http.ResponseWriter, r *http.Request, conf *config.ServerConfig, turnServer *TURNServer) {
+	servers := ClientICEServers(r, conf, turnServer)
+	if servers == nil {
+		servers = []webrtc.ICEServer{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store") // Credentials are per request
+	if err := json.NewEncoder(w).Encode(servers); err != nil {
+		log.Printf("Failed to write ICE servers: %v", err)
+	}
+}
+
+// turnPermissionHandler only lets viewers relay to this server. Credentials go
+// to every viewer, share-link guests included, so relaying anywhere else would
+// hand them a path to other hosts on the LAN, to services on loopback, or to
+// the internet through the camera.
+func turnPermissionHandler(conf *config.ServerConfig, relayIP net.IP) turn.PermissionHandler {
+	return func(clientAddr net.Addr, peerIP net.IP) bool {
+		if isServerICEAddress(conf, relayIP, peerIP) {
+			return true
+		}
+		log.Printf("TURN: refused relaying from %s to %s, not an address of this server", clientAddr, peerIP)
+		return false
+	}
+}
+
+// isServerICEAddress reports whether ip is one of the addresses this server's
+// ICE candidates carry: the relay address, a NAT 1:1 address, or an address of
+// an interface ICE uses. Interfaces are looked up on every call, as DHCP may
+// change them; permissions are only requested when a viewer connects.
+// Loopback is only allowed when the relay itself is advertised on loopback
+// (turn_public_ip = 127.0.0.1, for testing on one host): otherwise no viewer
+// can reach it, and it would expose services that only listen there.
+func isServerICEAddress(conf *config.ServerConfig, relayIP, ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	if ip.IsLoopback() {
+		return relayIP != nil && relayIP.IsLoopback()
+	}
+	if ip.Equal(relayIP) {
+		return true
+	}
+	for _, nat := range conf.ICENAT1To1IPs {
+		if ip.Equal(net.ParseIP(nat)) {
+			return true
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(conf.ICEInterfaces) > 0 && !slices.Contains(conf.ICEInterfaces, iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// turnRelayIP picks the address advertised in relay candidates
+func turnRelayIP(conf *config.ServerConfig) (net.IP, error) {
+	if conf.TURNPublicIP != "" {
+		return net.ParseIP(conf.TURNPublicIP), nil
+	}
+	for _, ip := range conf.ICENAT1To1IPs {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			return parsed, nil
+		}
+	}
+
+	// The local address of the default route; connecting a UDP socket sends nothing
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, fmt.Errorf("TURN relay address: set turn_public_ip: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"webrtc-ipcam/config"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// startLoopbackTURN starts the TURN server on a free port, relaying on loopback
+func startLoopbackTURN(t *testing.T) (*TURNServer, *config.ServerConfig) {
+	t.Helper()
+	// The server also listens for TCP on the port, which is free in practice
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	conf := &config.ServerConfig{
+		TURNPort:              port,
+		TURNPublicIP:          "127.0.0.1",
+		TURNRealm:             "webrtc-ipcam",
+		TURNCredentialMinutes: 5,
+	}
+	server, err := StartTURNServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, conf
+}
+
+// dialTURN connects a TURN client over UDP on loopback
+func dialTURN(t *testing.T, conf *config.ServerConfig, ice webrtc.ICEServer, password string) *turn.Client {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	serverAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(conf.TURNPort))
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: serverAddr,
+		TURNServerAddr: serverAddr,
+		Conn:           conn,
+		Username:       ice.Username,
+		Password:       password,
+		Realm:          conf.TURNRealm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// TestTURNRelayLoopback allocates a relay with server-issued credentials and
+// relays both ways to a peer on loopback, where the relay is advertised
+func TestTURNRelayLoopback(t *testing.T) {
+	server, conf := startLoopbackTURN(t)
+	ice, err := server.ICEServer("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "turn:127.0.0.1:" + strconv.Itoa(conf.TURNPort) + "?transport=udp"; ice.URLs[0] != want {
+		t.Fatalf("URL %s, want %s", ice.URLs[0], want)
+	}
+	client := dialTURN(t, conf, ice, ice.Credential.(string))
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	defer relay.Close()
+	if ip := relay.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("relay address %v, want 127.0.0.1", ip)
+	}
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// Writing to the peer creates the permission, which the server must grant
+	if _, err := relay.WriteTo([]byte("to peer"), peer.LocalAddr()); err != nil {
+		t.Fatalf("relay write: %v", err)
+	}
+	buf := make([]byte, 1500)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("peer read: %v", err)
+	}
+	if string(buf[:n]) != "to peer" {
+		t.Fatalf("peer got %q", buf[:n])
+	}
+
+	if _, err := peer.WriteTo([]byte("to client"), from); err != nil {
+		t.Fatal(err)
+	}
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("relay read: %v", err)
+	}
+	if string(buf[:n]) != "to client" {
+		t.Fatalf("client got %q", buf[:n])
+	}
+}
+
+func TestTURNRelayWrongPassword(t *testing.T) {
+	server, conf := startLoopbackTURN(t)
+	ice, err := server.ICEServer("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialTURN(t, conf, ice, "wrong")
+
+	if relay, err := client.Allocate(); err == nil {
+		relay.Close()
+		t.Fatal("allocated with a wrong password")
+	}
+}
+
+func TestIsServerICEAddress(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	public := net.ParseIP("198.51.100.10")
+	none := &config.ServerConfig{}
+	nat := &config.ServerConfig{ICENAT1To1IPs: []string{"203.0.113.7"}}
+
+	tests := []struct {
+		name    string
+		conf    *config.ServerConfig
+		relayIP net.IP
+		ip      string
+		want    bool
+	}{
+		{"relay address", none, public, "198.51.100.10", true},
+		{"NAT 1:1 address", nat, public, "203.0.113.7", true},
+		{"loopback, relay on loopback", none, loopback, "127.0.0.1", true},
+		{"other loopback, relay on loopback", none, loopback, "127.0.0.2", true},
+		{"loopback, public relay", none, public, "127.0.0.1", false},
+		{"IPv6 loopback, public relay", none, public, "::1", false},
+		{"unspecified", none, loopback, "0.0.0.0", false},
+		{"multicast", none, public, "224.0.0.251", false},
+		{"other LAN host", none, public, "10.255.255.1", false},
+		{"link-local", none, public, "169.254.1.1", false},
+		{"internet", nat, public, "8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isServerICEAddress(tt.conf, tt.relayIP, net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isServerICEAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
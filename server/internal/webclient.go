@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"webrtc-ipcam/config"
+)
+
+// embeddedClient holds the built web client when the binary is built with
+// -tags embedclient (see webclient_embed.go), and is nil otherwise
+var embeddedClient fs.FS
+
+// WebClient serves the built web client, so one binary is a complete camera
+type WebClient struct {
+	files fs.FS
+	etags map[string]string // Content hashes of embedded files, which have no modification time
+}
+
+// NewWebClient serves conf.ClientDir, or the embedded client with
+// client_embedded. It returns nil when neither is configured.
+func NewWebClient(conf *config.ServerConfig) (*WebClient, error) {
+	c := &WebClient{}
+	switch {
+	case conf.ClientDir != "":
+		c.files = os.DirFS(conf.ClientDir)
+	case conf.ClientEmbedded:
+		if embeddedClient == nil {
+			return nil, errors.New("client_embedded is set but this binary was built without the web client (build with -tags embedclient)")
+		}
+		c.files = embeddedClient
+		etags, err := hashFiles(c.files)
+		if err != nil {
+			return nil, fmt.Errorf("embedded web client: %w", err)
+		}
+		c.etags = etags
+	default:
+		return nil, nil
+	}
+
+	if _, err := fs.Stat(c.files, "index.html"); err != nil {
+		return nil, fmt.Errorf("web client has no index.html: %w", err)
+	}
+	return c, nil
+}
+
+// ServeHTTP serves a client file; directories serve their index.html
+func (c *WebClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	// Dotfiles are never part of a build
+	if strings.HasPrefix(name, ".") || strings.Contains(name, "/.") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := c.files.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info.IsDir() {
+		f.Close()
+		name = path.Join(name, "index.html")
+		if f, err = c.files.Open(name); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if info, err = f.Stat(); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "failed to read file", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	w.Header().Set("Cache-Control", clientCacheControl(name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if path.Base(name) == "manifest.json" || path.Ext(name) == ".webmanifest" {
+		w.Header().Set("Content-Type", "application/manifest+json")
+	}
+	if etag, ok := c.etags[name]; ok {
+		w.Header().Set("ETag", etag)
+	}
+	// Answers If-Modified-Since and If-None-Match with 304, and range requests
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// clientCacheControl lets browsers keep Vite's content-hashed assets forever,
+// but revalidate the entry points that reference them
+func clientCacheControl(name string) string {
+	switch {
+	case strings.HasPrefix(name, "assets/"):
+		return "public, max-age=31536000, immutable"
+	case path.Ext(name) == ".html", path.Base(name) == "manifest.json", path.Ext(name) == ".webmanifest":
+		return "no-cache"
+	default:
+		// Icons and MediaPipe's wasm files keep their names across builds
+		return "public, max-age=86400"
+	}
+}
+
+// hashFiles returns a strong ETag for every file
+func hashFiles(files fs.FS) (map[string]string, error) {
+	etags := make(map[string]string)
+	err := fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := files.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+		etags[name] = `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+		return nil
+	})
+	return etags, err
+}
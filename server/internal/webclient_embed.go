@@ -0,0 +1,17 @@
+//go:build embedclient
+
+package internal
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The built client, copied into internal/webclient by scripts/build.sh
+//
+//go:embed all:webclient
+var webclientFiles embed.FS
+
+func init() {
+	embeddedClient, _ = fs.Sub(webclientFiles, "webclient")
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-ipcam/config"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WHEP (WebRTC-HTTP Egress Protocol) playback, so standard players such as
+// GStreamer whepsrc, OBS or ffmpeg can view the camera:
+//
+//	POST   /whep       application/sdp offer -> 201 Created, SDP answer, Location: /whep/{id}, Link: ICE servers
+//	PATCH  /whep/{id}  application/trickle-ice-sdpfrag with the viewer's ICE candidates -> 204
+//	DELETE /whep/{id}  tear down the session -> 200
+
+const (
+	whepPath         = "/whep"
+	maxWHEPOfferSize = 64 * 1024
+)
+
+// WHEPSessions tracks the active WHEP sessions by resource id
+type WHEPSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*whepSession
+}
+
+type whepSession struct {
+	peerConn *webrtc.PeerConnection
+	etag     string
+}
+
+func NewWHEPSessions() *WHEPSessions {
+	return &WHEPSessions{sessions: make(map[string]*whepSession)}
+}
+
+func (s *WHEPSessions) get(id string) *whepSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[id]
+}
+
+func (s *WHEPSessions) remove(id string) *whepSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.sessions[id]
+	delete(s.sessions, id)
+	return session
+}
+
+// HandleWHEP creates a playback session from an SDP offer (POST /whep)
+func HandleWHEP(w http.ResponseWriter, r *http.Request, api *webrtc.API, codec webrtc.RTPCodecCapability, cm *ClientManager, conf *config.ServerConfig, turnServer *TURNServer, sessions *WHEPSessions) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hasContentType(r, "application/sdp") {
+		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWHEPOfferSize))
+	if err != nil || len(body) == 0 {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+
+	if !offerAcceptsCodec(offer.SDP, codec) {
+		log.Printf("Rejecting WHEP offer: no H264 payload compatible with %s", codec.SDPFmtpLine)
+		http.Error(w, "offer does not support H264 "+codec.SDPFmtpLine, http.StatusNotAcceptable)
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	peerConn, err := newViewerPeer(api, codec, cm, conf, viewerOptions{
+		viewer:  callerName(r),
+		shareID: shareID(r),
+		onClose: func() {
+			if sessions.remove(id) != nil {
+				log.Printf("WHEP session %s ended", id)
+			}
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to set up WHEP viewer: %v", err)
+		http.Error(w, "failed to set up peer connection", http.StatusInternalServerError)
+		return
+	}
+
+	// Registered before answering so the close callback always finds the session
+	session := &whepSession{peerConn: peerConn, etag: `"` + id + `"`}
+	sessions.mu.Lock()
+	sessions.sessions[id] = session
+	sessions.mu.Unlock()
+
+	if err := answerOffer(peerConn, offer); err != nil {
+		log.Printf("Failed to answer WHEP offer: %v", err)
+		http.Error(w, "failed to answer offer", http.StatusBadRequest)
+		peerConn.Close()
+		return
+	}
+
+	// The server cannot trickle its own candidates to a WHEP player, so the answer carries them all
+	waitForGathering(peerConn, 5*time.Second)
+	log.Printf("WHEP session %s created for %s", id, callerName(r))
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", whepPath+"/"+id)
+	w.Header().Set("ETag", session.etag)
+	for _, server := range ClientICEServers(r, conf, turnServer) {
+		for _, link := range iceServerLinks(server) {
+			w.Header().Add("Link", link)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	if _, err := io.WriteString(w, peerConn.LocalDescription().SDP); err != nil {
+		log.Printf("Failed to write WHEP answer: %v", err)
+	}
+}
+
+// HandleWHEPSession serves a session resource: PATCH adds trickled ICE candidates, DELETE ends the session
+func HandleWHEPSession(w http.ResponseWriter, r *http.Request, sessions *WHEPSessions) {
+	id := strings.TrimPrefix(r.URL.Path, whepPath+"/")
+	session := sessions.get(id)
+	if id == "" || session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		sessions.remove(id)
+		if err := session.peerConn.Close(); err != nil {
+			log.Printf("Failed to close WHEP session %s: %v", id, err)
+		}
+		log.Printf("WHEP session %s deleted by %s", id, callerName(r))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+			http.Error(w, "Content-Type must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != session.etag {
+			http.Error(w, "session has changed", http.StatusPreconditionFailed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWHEPOfferSize))
+		if err != nil {
+			http.Error(w, "invalid sdpfrag", http.StatusBadRequest)
+			return
+		}
+		if status, err := addTrickleCandidates(session.peerConn, string(body)); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// iceServerLinks formats an ICE server as Link headers (RFC 9725 section 4.6), so
+// the player can use the same STUN/TURN servers for its side of the connection
+func iceServerLinks(server webrtc.ICEServer) []string {
+	links := make([]string, 0, len(server.URLs))
+	for _, url := range server.URLs {
+		link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+		if credential, ok := server.Credential.(string); ok && server.Username != "" {
+			link += fmt.Sprintf(`; username=%q; credential=%q; credential-type="password"`, server.Username, credential)
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// addTrickleCandidates applies the candidates in an SDP fragment (RFC 8840) to the peer
+// connection. Returns the HTTP status to reply with when the fragment is rejected.
+func addTrickleCandidates(peerConn *webrtc.PeerConnection, frag string) (int, error) {
+	remote := peerConn.RemoteDescription()
+	if remote == nil {
+		return http.StatusConflict, errors.New("no remote description")
+	}
+
+	var mid string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			// A new username fragment means an ICE restart, which needs a new session
+			if !strings.Contains(remote.SDP, line) {
+				return http.StatusUnprocessableEntity, errors.New("ICE restart is not supported, create a new session")
+			}
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				m := mid
+				candidate.SDPMid = &m
+			}
+			if err := peerConn.AddICECandidate(candidate); err != nil {
+				return http.StatusBadRequest, err
+			}
+		}
+	}
+	return 0, nil
+}
+
+// hasContentType reports whether the request body has the given media type, ignoring parameters
+func hasContentType(r *http.Request, want string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == want
+}
+
+// newSessionID returns a random, unguessable resource id
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
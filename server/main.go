@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -21,8 +22,15 @@ func enableCORS(corsOrigin string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Allow any origin; for production, restrict to your front-end URL
 		w.Header().Set("Access-Control-Allow-Origin", corsOrigin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+		if corsOrigin != "*" {
+			// Lets a client on that origin send Basic credentials or cookies; browsers refuse this with "*"
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Vary", "Origin")
+		}
+		// WHEP clients read the session resource and its ETag from the response
+		w.Header().Set("Access-Control-Expose-Headers", "Location, ETag, Link")
 
 		// Handle preflight request
 		if r.Method == http.MethodOptions {
@@ -43,11 +51,8 @@ func main() {
 	confPath := filepath.Join(filepath.Dir(execPath), "server.conf")
 	conf := config.ParseConfig(confPath)
 
-	m := internal.SetupMediaEngine()
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
-
 	config := internal.CameraConfig{
-		ChannelBuffer: 2000,       // Handle bursts
+		ChannelBuffer: 300,        // Frames, handles bursts
 		ReadBuffer:    256 * 1024, // 256KB reads
 	}
 
@@ -57,59 +62,167 @@ func main() {
 	// Initialize recorder if recording directory is configured
 	var recorder *internal.RecorderManager
 	if conf.RecordingDir != "" {
-		recorder = internal.NewRecorderManager(conf.RecordingDir, conf.RecordingSkipConversion, conf.RecordingMaxMinutes)
+		recorder = internal.NewRecorderManager(conf)
 		clientManager.SetRecorder(recorder)
-		recorder.ProcessNALUs()
+		recorder.ProcessFrames()
 		log.Printf("Recording initialized: %s", conf.RecordingDir)
 	}
 
-	cameraCmd := fmt.Sprintf(
-		"rpicam-vid -t 0 --width %d --height %d --framerate %d --inline --rotation %d --codec h264 --nopreview -o -",
-		conf.Width, conf.Height, conf.Framerate, conf.Rotation,
-	)
-	// Add bitrate limiting if configured (critical for Pi Zero 2 performance)
-	if conf.Bitrate > 0 {
-		cameraCmd += fmt.Sprintf(" --bitrate %d", conf.Bitrate)
+	source, err := internal.NewVideoSourceFromConfig(conf)
+	if err != nil {
+		log.Fatalf("Invalid video source: %v", err)
 	}
 
-	if err := cameraManager.StartCamera(cameraCmd); err != nil {
+	if err := cameraManager.StartCamera(source); err != nil {
 		log.Fatalf("Failed to start camera: %v", err)
 	}
-	go clientManager.BroadcastNALUs(cameraManager.GetNALUChannel())
+	clientManager.SetKeyframeRequester(cameraManager)
+	go clientManager.BroadcastFrames(cameraManager.GetFrameChannel())
+
+	// Advertise the H264 profile the camera actually produces
+	profileLevelID := internal.DefaultProfileLevelID
+	if info := cameraManager.WaitForStreamInfo(10 * time.Second); info != nil {
+		profileLevelID = info.ProfileLevelID
+	} else {
+		log.Printf("WARNING: No SPS received from camera yet, assuming profile-level-id %s", profileLevelID)
+	}
+
+	codec := internal.H264Codec(profileLevelID)
+	m, err := internal.SetupMediaEngine(codec)
+	if err != nil {
+		log.Fatalf("Failed to register H264 codec: %v", err)
+	}
+	registry, err := internal.SetupInterceptors(m, conf.NackBufferSize)
+	if err != nil {
+		log.Fatalf("Failed to set up RTP interceptors: %v", err)
+	}
+	settingEngine, err := internal.NewSettingEngine(conf)
+	if err != nil {
+		log.Fatalf("Failed to set up ICE networking: %v", err)
+	}
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(*settingEngine),
+	)
+	iceStatus := internal.NewICEStatus(api, conf)
+	go iceStatus.LogCandidates()
 
-	http.Handle("/status", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Embedded TURN relay; viewers get short-lived credentials from /ice/servers, /ws and /whep
+	var turnServer *internal.TURNServer
+	if conf.TURNPort > 0 {
+		turnServer, err = internal.StartTURNServer(conf)
+		if err != nil {
+			log.Fatalf("Failed to start TURN server: %v", err)
+		}
+	}
+
+	// Every route except the web client requires authentication when any auth method is
+	// configured: viewers may watch, recorders may also record and download, admins may do everything
+	// Guests may also use share links, on the live view or download routes their link is scoped to
+	shareLinks, err := internal.NewShareLinks(conf, func(id string) {
+		if n := clientManager.DisconnectShare(id); n > 0 {
+			log.Printf("Disconnected %d viewers of ended share link %s", n, id)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Failed to load share links: %v", err)
+	}
+	authenticator := internal.NewAuthenticator(conf, shareLinks)
+
+	http.Handle("/status", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleViewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		if _, err := w.Write([]byte("OK")); err != nil {
 			log.Printf("Failed to write status response: %v", err)
 		}
-	})))
+	}))))
+
+	// The web client itself needs no credentials; it asks for them when calling the API
+	webClient, err := internal.NewWebClient(conf)
+	if err != nil {
+		log.Fatalf("Failed to serve web client: %v", err)
+	}
+	if webClient != nil {
+		http.Handle("/", webClient)
+		log.Println("Serving web client at /")
+	}
 
-	http.Handle("/offer", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		internal.HandleOffer(w, r, api, clientManager, conf)
+	http.Handle("/cameras", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleCameras(w, r, conf)
+	}))))
+
+	http.Handle("/camera/status", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleCameraStatus(w, r, cameraManager)
+	}))))
+
+	http.Handle("/offer", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleOffer(w, r, api, codec, clientManager, conf)
+	}))))
+
+	http.Handle("/ice/servers", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleICEServers(w, r, conf, turnServer)
+	}))))
+
+	http.Handle("/ice/status", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleICEStatus(w, r, iceStatus)
+	}))))
+
+	// WebSocket signaling with trickle ICE, renegotiation and server-initiated close
+	signalingHub := internal.NewSignalingHub(conf.CorsOrigin)
+	http.Handle("/ws", authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleSignalingWS(w, r, api, codec, clientManager, conf, turnServer, signalingHub)
 	})))
 
+	// WHEP playback for standard players (POST offer, PATCH trickle ICE, DELETE session)
+	whepSessions := internal.NewWHEPSessions()
+	http.Handle("/whep", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleWHEP(w, r, api, codec, clientManager, conf, turnServer, whepSessions)
+	}))))
+	http.Handle("/whep/", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleWHEPSession(w, r, whepSessions)
+	}))))
+
+	http.Handle("/admin/config", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleAdminConfig(w, r, conf)
+	}))))
+
+	http.Handle("/share", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleShares(w, r, shareLinks, recorder)
+	}))))
+	http.Handle("/share/", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internal.HandleShareRevoke(w, r, shareLinks)
+	}))))
+
 	// Recording endpoints (status is always available, others only if recorder is configured)
-	http.Handle("/record/status", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/record/status", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleViewer, internal.ShareLive, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		internal.HandleRecordStatus(w, r, recorder, conf.RecordingUnavailableReason)
-	})))
+	}))))
 
 	if recorder != nil {
-		http.Handle("/record/start", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Handle("/record/start", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleRecorder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			internal.HandleRecordStart(w, r, recorder)
-		})))
+		}))))
 
-		http.Handle("/record/stop", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Handle("/record/stop", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleRecorder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			internal.HandleRecordStop(w, r, recorder)
-		})))
+		}))))
 
-		http.Handle("/record/list", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Handle("/record/list", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleRecorder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			internal.HandleRecordList(w, r, recorder)
-		})))
+		}))))
+
+		http.Handle("/record/jobs", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleRecorder, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			internal.HandleRecordJobs(w, r, recorder)
+		}))))
 
-		http.Handle("/record/download/", enableCORS(conf.CorsOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Handle("/record/download/", enableCORS(conf.CorsOrigin, authenticator.RequireOrShare(internal.RoleRecorder, internal.ShareRecording, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			internal.HandleRecordDownload(w, r, recorder)
-		})))
+		}))))
+
+		http.Handle("/record/delete/", enableCORS(conf.CorsOrigin, authenticator.Require(internal.RoleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			internal.HandleRecordDelete(w, r, recorder)
+		}))))
 	}
 
 	port := fmt.Sprintf(":%d", conf.Addr)
@@ -117,14 +230,50 @@ func main() {
 		Addr: port,
 	}
 
+	// HTTPS with a provided or self-signed certificate, reloaded when the files change
+	var certs *internal.CertReloader
+	if conf.TLS {
+		certs, err = internal.NewCertReloader(conf)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
 	// Start HTTP server in goroutine
 	go func() {
-		log.Printf("WebRTC server running on %s", port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if conf.TLS {
+			log.Printf("WebRTC server running on %s (HTTPS)", port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("WebRTC server running on %s", port)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 
+	// Plain HTTP port that only sends browsers to HTTPS
+	var redirectServer *http.Server
+	if conf.HTTPRedirectPort > 0 {
+		redirectServer = &http.Server{
+			Addr:              fmt.Sprintf(":%d", conf.HTTPRedirectPort),
+			Handler:           internal.HTTPSRedirect(conf.Addr),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Redirecting HTTP on :%d to HTTPS", conf.HTTPRedirectPort)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("HTTP redirect server error: %v", err)
+			}
+		}()
+	}
+
 	// Wait for shutdown signal
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
@@ -136,10 +285,27 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// Tell WebSocket viewers to reconnect; Shutdown does not close hijacked connections
+	signalingHub.CloseAll("server shutting down")
+
 	// Shutdown HTTP server
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			log.Printf("HTTP redirect server shutdown error: %v", err)
+		}
+	}
+	if certs != nil {
+		certs.Close()
+	}
+
+	if turnServer != nil {
+		if err := turnServer.Close(); err != nil {
+			log.Printf("TURN server shutdown error: %v", err)
+		}
+	}
 
 	// Stop camera
 	if err := cameraManager.Stop(); err != nil {